@@ -0,0 +1,191 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// accountPrefix returns the storage prefix for the account
+// registered at the CA with the given email address.
+func accountPrefix(ca, email string) string {
+	if email == "" {
+		email = "default"
+	}
+	return path.Join("acme", issuerKey(ca), "users", safeKey(email))
+}
+
+// accountKeyKey returns the storage key of the account's private key.
+func accountKeyKey(ca, email string) string {
+	return path.Join(accountPrefix(ca, email), "account.key")
+}
+
+// accountRegKey returns the storage key of the account's registration.
+func accountRegKey(ca, email string) string {
+	return path.Join(accountPrefix(ca, email), "account.json")
+}
+
+// getAccount returns the ACME account for the configured CA and email. An account
+// that has been registered before is loaded from storage, otherwise a new one is
+// registered and stored so that it will be reused on later runs. A stored key
+// whose registration failed is registered again.
+func (m *AcmeManager) getAccount(ctx context.Context, client *acme.Client) (acme.Account, error) {
+	lockKey := path.Join(accountPrefix(m.CA, m.Email), "account")
+	if err := m.Config.Storage.Lock(ctx, lockKey); err != nil {
+		return acme.Account{}, fmt.Errorf("locking account: %v", err)
+	}
+	defer m.unlock(lockKey)
+
+	account, err := m.loadAccount(ctx, client)
+	if err == nil {
+		return account, nil
+	}
+	if !m.Config.Storage.Exists(ctx, accountKeyKey(m.CA, m.Email)) {
+		return m.newAccount(ctx, client, nil)
+	}
+	return acme.Account{}, err
+}
+
+// loadAccount loads a previously registered account from storage.
+func (m *AcmeManager) loadAccount(ctx context.Context, client *acme.Client) (acme.Account, error) {
+	var account acme.Account
+	keyPEM, err := m.Config.Storage.Load(ctx, accountKeyKey(m.CA, m.Email))
+	if err != nil {
+		return account, fmt.Errorf("loading account key: %v", err)
+	}
+	privateKey, err := decodeKey(keyPEM)
+	if err != nil {
+		return account, fmt.Errorf("decoding account key: %v", err)
+	}
+
+	regJSON, err := m.Config.Storage.Load(ctx, accountRegKey(m.CA, m.Email))
+	if err == nil {
+		err = json.Unmarshal(regJSON, &account)
+		if err != nil {
+			return account, fmt.Errorf("decoding account: %v", err)
+		}
+	}
+	account.PrivateKey = privateKey
+
+	if account.Location == "" {
+		// only the key survived, look up the account it belongs to
+		account, err = client.GetAccount(ctx, account)
+		var problem acme.Problem
+		if errors.As(err, &problem) && problem.Type == acme.ProblemTypeAccountDoesNotExist {
+			// registering the key failed, e.g. because of
+			// wrong EAB credentials, so register it again
+			return m.newAccount(ctx, client, privateKey)
+		}
+		if err != nil {
+			return account, fmt.Errorf("looking up account: %v", err)
+		}
+		if err := m.storeAccount(ctx, account); err != nil {
+			return account, err
+		}
+	}
+	return account, nil
+}
+
+// newAccount registers a new account with the CA and stores it. If privateKey
+// is nil, a new key is generated, otherwise the stored privateKey is registered.
+// The operator must have agreed to the CA's terms of service.
+func (m *AcmeManager) newAccount(ctx context.Context, client *acme.Client, privateKey *ecdsa.PrivateKey) (acme.Account, error) {
+	if !m.Config.AgreeTOS {
+		return acme.Account{}, m.tosError(ctx, client)
+	}
+
+	storeKey := privateKey == nil
+	if storeKey {
+		var err error
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return acme.Account{}, fmt.Errorf("generating account key: %v", err)
+		}
+	}
+
+	account := acme.Account{
+		TermsOfServiceAgreed: m.Config.AgreeTOS,
+		PrivateKey:           privateKey,
+	}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	if m.Config.EABKeyID != "" {
+		eab := acme.EAB{KeyID: m.Config.EABKeyID, MACKey: m.Config.EABHMACKey}
+		if err := account.SetExternalAccountBinding(ctx, client, eab); err != nil {
+			return account, fmt.Errorf("external account binding: %v", err)
+		}
+	} else if dir, err := client.GetDirectory(ctx); err == nil && dir.Meta != nil && dir.Meta.ExternalAccountRequired {
+		return account, fmt.Errorf("%s requires external account binding, set eab_key_id and eab_hmac_key", m.CA)
+	}
+
+	// store the key before registering, so that the account
+	// can still be looked up if storing the registration fails
+	if storeKey {
+		keyPEM, err := encodeKey(privateKey)
+		if err != nil {
+			return account, fmt.Errorf("encoding account key: %v", err)
+		}
+		if err := m.Config.Storage.Store(ctx, accountKeyKey(m.CA, m.Email), keyPEM); err != nil {
+			return account, fmt.Errorf("storing account key: %v", err)
+		}
+	}
+
+	log.Infof("Registering new ACME account with %s", m.CA)
+	account, err := client.NewAccount(ctx, account)
+	if err != nil {
+		return account, fmt.Errorf("new account: %v", err)
+	}
+	return account, m.storeAccount(ctx, account)
+}
+
+// tosError returns the error reported when a new account has to be
+// registered without agree_tos. It points to the terms of service
+// published in the CA's directory, if there are any.
+func (m *AcmeManager) tosError(ctx context.Context, client *acme.Client) error {
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return fmt.Errorf("registering an account with %s requires agree_tos, could not get its terms of service: %v", m.CA, err)
+	}
+	if dir.Meta == nil || dir.Meta.TermsOfService == "" {
+		return fmt.Errorf("registering an account with %s requires agree_tos", m.CA)
+	}
+	return fmt.Errorf("registering an account with %s requires agree_tos, read the terms of service at %s", m.CA, dir.Meta.TermsOfService)
+}
+
+// storeAccount stores the registration of account.
+func (m *AcmeManager) storeAccount(ctx context.Context, account acme.Account) error {
+	regJSON, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("encoding account: %v", err)
+	}
+	if err := m.Config.Storage.Store(ctx, accountRegKey(m.CA, m.Email), regJSON); err != nil {
+		return fmt.Errorf("storing account: %v", err)
+	}
+	return nil
+}
+
+func encodeKey(privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	x509Encoded, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: x509Encoded}), nil
+}
+
+func decodeKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
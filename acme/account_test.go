@@ -0,0 +1,126 @@
+package acme
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T, srv *testACMEServer) *AcmeManager {
+	cfg := NewConfig([]string{"example.com"}, NewMemoryStorage())
+	cfg.CA = srv.directoryURL()
+	cfg.TrustedRoots = srv.roots()
+	cfg.AgreeTOS = true
+	m, err := NewACMEManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %s", err)
+	}
+	return m
+}
+
+func TestGetAccountReuse(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestManager(t, srv)
+	ctx := context.Background()
+
+	first, err := m.getAccount(ctx, m.newClient())
+	if err != nil {
+		t.Fatalf("Failed to get account: %s", err)
+	}
+	second, err := m.getAccount(ctx, m.newClient())
+	if err != nil {
+		t.Fatalf("Failed to get account again: %s", err)
+	}
+
+	if first.Location != second.Location {
+		t.Errorf("Expected account %s to be reused, got %s", first.Location, second.Location)
+	}
+	if n := srv.numAccounts(); n != 1 {
+		t.Errorf("Expected 1 registered account, got %d", n)
+	}
+}
+
+func TestGetAccountAgreeTOS(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestManager(t, srv)
+	m.Config.AgreeTOS = false
+
+	_, err := m.getAccount(context.Background(), m.newClient())
+	if err == nil {
+		t.Fatal("Expected error without agree_tos")
+	}
+	if !strings.Contains(err.Error(), srv.URL+"/terms") {
+		t.Errorf("Expected error to point to the terms of service, got: %s", err)
+	}
+	if n := srv.numAccounts(); n != 0 {
+		t.Errorf("Expected no registered account, got %d", n)
+	}
+}
+
+func TestGetAccountExternalAccountBinding(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		keyID              string
+		hmacKey            string
+		shouldErr          bool
+		expectedErrContent string // substring from the expected error. Empty for positive cases.
+	}{
+		{"kid-1", base64.RawURLEncoding.EncodeToString(hmacKey), false, ""},
+		{"", "", true, "requires external account binding"},
+		{"kid-2", base64.RawURLEncoding.EncodeToString(hmacKey), true, "unexpected binding header"},
+		{"kid-1", base64.RawURLEncoding.EncodeToString([]byte("wrong")), true, "invalid binding signature"},
+		{"kid-1", "not/base64url=", true, "base64-decoding MAC key"},
+	}
+
+	for i, test := range tests {
+		srv := newTestACMEServer(t)
+		srv.eabKeyID = "kid-1"
+		srv.eabKey = hmacKey
+		m := newTestManager(t, srv)
+		m.Config.EABKeyID = test.keyID
+		m.Config.EABHMACKey = test.hmacKey
+
+		_, err := m.getAccount(context.Background(), m.newClient())
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found none", i)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: Expected no error but found: %v", i, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v", i, test.expectedErrContent, err)
+			}
+			continue
+		}
+		if n := srv.numAccounts(); n != 1 {
+			t.Errorf("Test %d: Expected 1 registered account, got %d", i, n)
+		}
+	}
+}
+
+func TestGetAccountExternalAccountBindingRetry(t *testing.T) {
+	hmacKey := base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	srv := newTestACMEServer(t)
+	srv.eabKeyID = "kid-1"
+	srv.eabKey = []byte("0123456789abcdef0123456789abcdef")
+	m := newTestManager(t, srv)
+	m.Config.EABKeyID = "kid-2"
+	m.Config.EABHMACKey = hmacKey
+
+	_, err := m.getAccount(context.Background(), m.newClient())
+	if err == nil || !strings.Contains(err.Error(), "unexpected binding header") {
+		t.Fatalf("Expected registration with the wrong key ID to fail, got: %v", err)
+	}
+
+	// the key stored by the failed registration is registered on the next try
+	m.Config.EABKeyID = "kid-1"
+	if _, err := m.getAccount(context.Background(), m.newClient()); err != nil {
+		t.Fatalf("Expected registration with the correct credentials to succeed, got: %v", err)
+	}
+	if n := srv.numAccounts(); n != 1 {
+		t.Errorf("Expected 1 registered account, got %d", n)
+	}
+}
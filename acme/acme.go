@@ -5,109 +5,68 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"net/http"
-	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/coredns/coredns/core/dnsserver"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez"
 	"github.com/mholt/acmez/acme"
 )
 
-const (
-	etcDir = "/etc/coredns/"
-)
-
-func encodeKey(privateKey *ecdsa.PrivateKey) []byte {
-	x509Encoded, _ := x509.MarshalECPrivateKey(privateKey)
-	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
+var log = clog.NewWithPlugin("tls")
 
-	return pemEncoded
+// StartACME registers the ACME account of the manager, so that a misconfigured
+// account fails setup right away. It gives up once ctx is done.
+func StartACME(ctx context.Context, manager *AcmeManager) error {
+	defer manager.httpTransport().CloseIdleConnections()
+	_, err := manager.getAccount(ctx, manager.newClient())
+	return err
 }
 
-func StartACME(conf *dnsserver.Config, domainName string) (*tls.Config, error) {
-	fmt.Println("StartACME")
-	storage := NewFileStorage(etcDir)
-	config := NewConfig(domainName, storage)
-	manager, err := NewACMEManager(config)
-	if err != nil {
-		return nil, err
-	}
-	// check if a certificate already exists
-
-	// start renewal loop for this existing certificate
-
-	// obtain a certificate
-	tlsconf, err := manager.obtainCertificate(conf, domainName)
-	if err != nil {
-		return nil, err
+// ObtainAndRenew obtains a certificate for the configured domains, unless a valid
+// one is in storage, and then keeps it renewed until ctx is done. It has to run in
+// the background once CoreDNS is serving, because the dns-01 challenges are answered
+// by the ChallengeHandler in the plugin chain.
+func (m *AcmeManager) ObtainAndRenew(ctx context.Context) {
+	err := m.renewManagedCertificates(ctx)
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("Failed to obtain certificate for %s: %v", strings.Join(m.Config.Domains, ", "), err)
 	}
 
-	// start renewal loop for this newly obtained certificate
-	go manager.RenewalLoop()
-
-	fmt.Println("End of StartACME")
-	return tlsconf, nil
+	// start renewal loop for this certificate
+	m.RenewalLoop(ctx)
 }
 
-func (m *AcmeManager) obtainCertificate(conf *dnsserver.Config, domainName string) (*tls.Config, error) {
-	fmt.Println("Start obtainCertificate")
-	fmt.Printf("Let's get a cert for: %s \n", domainName)
-
-	domains := []string{domainName}
-
-	ctx := context.Background()
-
-	fmt.Println("Creating PKey")
+// obtainCertificate runs the order flow for a certificate for domains and returns
+// the PEM encoded certificate chain and private key.
+func (m *AcmeManager) obtainCertificate(ctx context.Context, domains []string) (certPEM, keyPEM []byte, err error) {
+	log.Debugf("Obtaining certificate for %s from %s", strings.Join(domains, ", "), m.CA)
 	certPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("generating certificate key: %v", err)
+		return nil, nil, fmt.Errorf("generating certificate key: %v", err)
 	}
 
-	fmt.Println("Creating CSR")
 	csrTemplate := &x509.CertificateRequest{DNSNames: domains}
 	csrDER, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, certPrivateKey)
 	if err != nil {
-		return nil, fmt.Errorf("generating CSR: %v", err)
+		return nil, nil, fmt.Errorf("generating CSR: %v", err)
 	}
 	csr, err := x509.ParseCertificateRequest(csrDER)
 	if err != nil {
-		return nil, fmt.Errorf("parsing generated CSR: %v", err)
-	}
-
-	fmt.Println("Creating Account PKey")
-	accountPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("generating account key: %v", err)
-	}
-
-	account := acme.Account{
-		Contact:              []string{"mailto:test@test.test"},
-		TermsOfServiceAgreed: true,
-		PrivateKey:           accountPrivateKey,
+		return nil, nil, fmt.Errorf("parsing generated CSR: %v", err)
 	}
 
-	client := &acme.Client{
-		Directory: "https://pebble:14000/dir", // default pebble endpoint
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // we're just tinkering locally - REMOVE THIS FOR PRODUCTION USE!
-				},
-			},
-		},
-	}
+	client := m.newClient()
 
-	fmt.Println("Creating Account")
-	account, err = client.NewAccount(ctx, account)
+	account, err := m.getAccount(ctx, client)
 	if err != nil {
-		return nil, fmt.Errorf("new account: %v", err)
+		return nil, nil, err
 	}
 
 	// now we can actually get a cert; first step is to create a new order
-	fmt.Println("Creating Order")
 	var ids []acme.Identifier
 	for _, domain := range domains {
 		ids = append(ids, acme.Identifier{Type: "dns", Value: domain})
@@ -115,82 +74,37 @@ func (m *AcmeManager) obtainCertificate(conf *dnsserver.Config, domainName strin
 	order := acme.Order{Identifiers: ids}
 	order, err = client.NewOrder(ctx, account, order)
 	if err != nil {
-		return nil, fmt.Errorf("creating new order: %v", err)
+		return nil, nil, fmt.Errorf("creating new order: %v", err)
 	}
 
 	// each identifier on the order should now be associated with an
 	// authorization object; we must make the authorization "valid"
 	// by solving any of the challenges offered for it
+	var authzs []acme.Authorization
 	for _, authzURL := range order.Authorizations {
-		fmt.Println("Getting Challenge")
 		authz, err := client.GetAuthorization(ctx, account, authzURL)
 		if err != nil {
-			return nil, fmt.Errorf("getting authorization %q: %v", authzURL, err)
-		}
-
-		// pick any available challenge to solve
-		var challenge acme.Challenge
-
-		i := 0
-		for {
-			challenge = authz.Challenges[i]
-			if challenge.Type != "dns-01" {
-				fmt.Println("Not DNS")
-			} else {
-				fmt.Println("DNS")
-				break
-			}
-			i++
+			return nil, nil, fmt.Errorf("getting authorization %q: %v", authzURL, err)
 		}
 
-		solver := DNSSolver{
-			Addr:   "127.0.0.1:53",
-			Config: conf,
+		// an authorization may still be valid from an earlier order
+		if authz.Status == acme.StatusValid {
+			continue
 		}
-		ctx := context.Background()
-
-		//Prepare to solve the challenge
-		solver.Present(ctx, challenge)
-
-		fmt.Println("Challenge URL:", challenge.URL)
-		fmt.Println(challenge.DNS01TXTRecordName())
-		fmt.Println(challenge.Identifier)
-
-		// once you are ready to solve the challenge, let the ACME
-		// server know it should begin
-		fmt.Println("Starting Challenge Now!")
-		challenge, err = client.InitiateChallenge(ctx, account, challenge)
-		if err != nil {
-			return nil, fmt.Errorf("initiating challenge %q: %v", challenge.URL, err)
-		}
-
-		// wait until the challenge has been solved
-		solver.Wait(ctx, challenge)
-
-		// now the challenge should be under way; at this point, we can
-		// continue initiating all the other challenges so that they are
-		// all being solved in parallel (this saves time when you have a
-		// large number of SANs on your certificate), but this example is
-		// simple, so we will just do one at a time; we wait for the ACME
-		// server to tell us the challenge has been solved by polling the
-		// authorization status
-		authz, err = client.PollAuthorization(ctx, account, authz)
-		if err != nil {
-			return nil, fmt.Errorf("solving challenge: %v", err)
-		}
-
-		// if we got here, then the challenge was solved successfully, hurray!
-		fmt.Println("HAPPY SUCCESS! - Let's clean up")
-		solver.CleanUp(ctx, challenge)
+		authzs = append(authzs, authz)
+	}
+	err = solveAuthorizations(ctx, client, account, m.Config.Challenges, m.solvers(), authzs, m.Config.MaxConcurrentChallenges)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// to request a certificate, we finalize the order; this function
 	// will poll the order status for us and return once the cert is
 	// ready (or until there is an error)
-	fmt.Println("Finalizing Order")
+	log.Debugf("Finalizing order %s", order.Location)
 	order, err = client.FinalizeOrder(ctx, account, order, csr.Raw)
 	if err != nil {
-		return nil, fmt.Errorf("finalizing order: %v", err)
+		return nil, nil, fmt.Errorf("finalizing order: %v", err)
 	}
 
 	// we can now download the certificate; the server should actually
@@ -200,47 +114,155 @@ func (m *AcmeManager) obtainCertificate(conf *dnsserver.Config, domainName strin
 	// your own requirements
 	certChains, err := client.GetCertificateChain(ctx, account, order.Certificate)
 	if err != nil {
-		return nil, fmt.Errorf("downloading certs: %v", err)
+		return nil, nil, fmt.Errorf("downloading certs: %v", err)
 	}
 
-	var tlsCerts []tls.Certificate
+	if len(certChains) == 0 {
+		return nil, nil, fmt.Errorf("no certificate chain for order %q", order.Location)
+	}
 
-	err = os.MkdirAll(etcDir, os.ModePerm)
+	certPrivKeyPem, err := encodeKey(certPrivateKey)
 	if err != nil {
-		fmt.Println("Error during os.MkdirAll")
+		return nil, nil, fmt.Errorf("encoding certificate key: %v", err)
 	}
 
-	certPrivKeyPem := encodeKey(certPrivateKey)
-	fmt.Println(string(certPrivKeyPem))
+	return certChains[0].ChainPEM, certPrivKeyPem, nil
+}
+
+// cleanupTimeout bounds cleaning up after an operation
+// whose context may already be done.
+const cleanupTimeout = 30 * time.Second
+
+// cleanupContext returns the context to clean up after an operation with,
+// which is not cancelled along with the operation's context.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// pendingChallenge is the challenge picked to make authz valid, and its solver.
+type pendingChallenge struct {
+	authz     acme.Authorization
+	challenge acme.Challenge
+	solver    acmez.Solver
+}
 
-	// all done! store it somewhere safe, along with its key
-	for _, cert := range certChains {
-		fmt.Printf("Certificate %q:\n%s\n\n", cert.URL, cert.ChainPEM)
-		err := os.WriteFile(etcDir+"cert.pem", cert.ChainPEM, 0644)
+// solveAuthorizations makes authzs valid by solving the first of their challenges
+// in the order of challengeTypes. All challenges are presented at once and waited
+// for together, so that the TXT records propagate in parallel. Then they are
+// initiated and polled concurrently, at most maxConcurrent at a time. The first
+// error stops the others. Every presented challenge is cleaned up, whether the
+// authorizations were solved or not.
+func solveAuthorizations(ctx context.Context, client *acme.Client, account acme.Account, challengeTypes []string, solvers map[string]acmez.Solver, authzs []acme.Authorization, maxConcurrent int) error {
+	var pending []pendingChallenge
+	for _, authz := range authzs {
+		challenge, solver, err := pickChallenge(authz, challengeTypes, solvers)
 		if err != nil {
-			fmt.Println("Error Writing cert.pem")
-			fmt.Println(err)
+			return err
 		}
-		err = os.WriteFile(etcDir+"key.pem", encodeKey(certPrivateKey), 0644)
-		if err != nil {
-			fmt.Println("Error Writing key.pem")
-			fmt.Println(err)
+		pending = append(pending, pendingChallenge{authz: authz, challenge: challenge, solver: solver})
+	}
+
+	// prepare to solve the challenges
+	var presented []pendingChallenge
+	defer func() {
+		// ctx may be cancelled by now, e.g. by Stop, but the
+		// records at a DNS provider still have to be deleted
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+		for _, p := range presented {
+			if err := p.solver.CleanUp(cleanupCtx, p.challenge); err != nil {
+				log.Warningf("Failed to clean up challenge for %s: %v", p.authz.IdentifierValue(), err)
+			}
+		}
+	}()
+	for _, p := range pending {
+		log.Debugf("Presenting %s challenge for %s", p.challenge.Type, p.authz.IdentifierValue())
+		if err := p.solver.Present(ctx, p.challenge); err != nil {
+			return fmt.Errorf("presenting challenge for %s: %v", p.authz.IdentifierValue(), err)
+		}
+		presented = append(presented, p)
+	}
+
+	// wait until the challenges can be solved, e.g. the TXT records
+	// are published; they were all presented before, so the first
+	// wait covers most of the propagation of the others
+	for _, p := range pending {
+		if waiter, ok := p.solver.(acmez.Waiter); ok {
+			if err := waiter.Wait(ctx, p.challenge); err != nil {
+				return fmt.Errorf("waiting for challenge %q: %v", p.challenge.URL, err)
+			}
 		}
+	}
 
-		//tlsCert, err := tls.LoadX509KeyPair(string(cert.ChainPEM), certPrivateKey.D.String())
-		//if err != nil {
-		//fmt.Println("Error Loading Certificate!!!")
-		//fmt.Println(err)
-		//}
-		//tlsCerts = append(tlsCerts, tlsCert)
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentChallenges
+	}
+	solveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, maxConcurrent)
+	for _, p := range pending {
+		wg.Add(1)
+		go func(p pendingChallenge) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-solveCtx.Done():
+				return
+			}
+			if err := solveChallenge(solveCtx, client, account, p); err != nil {
+				// the others fail once cancelled, only the cause is returned
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				cancel()
+			}
+		}(p)
 	}
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
 
-	tls := &tls.Config{
-		Certificates: tlsCerts,
+// solveChallenge lets the CA know that the presented challenge is ready
+// to be validated and polls its authorization until it is valid.
+func solveChallenge(ctx context.Context, client *acme.Client, account acme.Account, p pendingChallenge) error {
+	log.Debugf("Initiating challenge for %s", p.authz.IdentifierValue())
+	if _, err := client.InitiateChallenge(ctx, account, p.challenge); err != nil {
+		return fmt.Errorf("initiating challenge %q: %v", p.challenge.URL, err)
 	}
-	//var err error
-	fmt.Println("End of obtainCertificate")
-	return tls, nil
+
+	// we wait for the ACME server to tell us the challenge
+	// has been solved by polling the authorization status
+	if _, err := client.PollAuthorization(ctx, account, p.authz); err != nil {
+		return fmt.Errorf("solving challenge for %s: %v", p.authz.IdentifierValue(), err)
+	}
+	return nil
 }
 
-// exists returns whether the given file or directory exists
+// pickChallenge returns the challenge of authz to solve, which is the
+// first one in the order of challengeTypes, and its solver.
+func pickChallenge(authz acme.Authorization, challengeTypes []string, solvers map[string]acmez.Solver) (acme.Challenge, acmez.Solver, error) {
+	for _, typ := range challengeTypes {
+		solver := solvers[typ]
+		if solver == nil {
+			continue
+		}
+		for _, challenge := range authz.Challenges {
+			if challenge.Type == typ {
+				return challenge, solver, nil
+			}
+		}
+	}
+	return acme.Challenge{}, nil, fmt.Errorf("none of the challenges %v is offered for %s", challengeTypes, authz.IdentifierValue())
+}
@@ -0,0 +1,252 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// recordingSolver records the challenges it presents,
+// which the testACMEServer validates right away.
+type recordingSolver struct {
+	mu        sync.Mutex
+	presented []string
+}
+
+func (s *recordingSolver) Present(_ context.Context, challenge acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presented = append(s.presented, challenge.Type+" "+challenge.Identifier.Value)
+	return nil
+}
+
+func (s *recordingSolver) CleanUp(context.Context, acme.Challenge) error { return nil }
+
+func TestPickChallenge(t *testing.T) {
+	solver := &recordingSolver{}
+	solvers := map[string]acmez.Solver{
+		acme.ChallengeTypeDNS01:     solver,
+		acme.ChallengeTypeTLSALPN01: solver,
+	}
+	authz := acme.Authorization{
+		Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+		Challenges: []acme.Challenge{
+			{Type: acme.ChallengeTypeHTTP01},
+			{Type: acme.ChallengeTypeDNS01},
+			{Type: acme.ChallengeTypeTLSALPN01},
+		},
+	}
+
+	tests := []struct {
+		challengeTypes []string
+		expected       string // expected challenge type, empty if none can be solved
+	}{
+		{[]string{acme.ChallengeTypeDNS01}, acme.ChallengeTypeDNS01},
+		{[]string{acme.ChallengeTypeTLSALPN01, acme.ChallengeTypeDNS01}, acme.ChallengeTypeTLSALPN01},
+		{[]string{acme.ChallengeTypeDNS01, acme.ChallengeTypeTLSALPN01}, acme.ChallengeTypeDNS01},
+		// there is no solver for http-01
+		{[]string{acme.ChallengeTypeHTTP01, acme.ChallengeTypeTLSALPN01}, acme.ChallengeTypeTLSALPN01},
+		{[]string{acme.ChallengeTypeHTTP01}, ""},
+		{nil, ""},
+	}
+
+	for i, test := range tests {
+		challenge, _, err := pickChallenge(authz, test.challengeTypes, solvers)
+		if test.expected == "" {
+			if err == nil || !strings.Contains(err.Error(), "example.com") {
+				t.Errorf("Test %d: Expected error naming the identifier, got: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Failed to pick challenge: %s", i, err)
+			continue
+		}
+		if challenge.Type != test.expected {
+			t.Errorf("Test %d: Expected %s challenge, got %s", i, test.expected, challenge.Type)
+		}
+	}
+}
+
+func TestObtainCertificateChallenges(t *testing.T) {
+	srv := newTestACMEServer(t)
+	srv.challengeTypes = []string{acme.ChallengeTypeDNS01, acme.ChallengeTypeHTTP01, acme.ChallengeTypeTLSALPN01}
+	m := newTestManager(t, srv)
+	solver := &recordingSolver{}
+	m.DNS01Solver, m.HTTP01Solver, m.TLSALPN01Solver = solver, solver, solver
+	m.Config.Domains = []string{"example.com", "example.net", "*.example.org"}
+	m.Config.Challenges = []string{acme.ChallengeTypeTLSALPN01, acme.ChallengeTypeDNS01}
+
+	if _, _, err := m.obtainCertificate(context.Background(), m.Config.Domains); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+
+	// wildcards can only be validated with dns-01
+	expected := []string{"dns-01 example.org", "tls-alpn-01 example.com", "tls-alpn-01 example.net"}
+	sort.Strings(solver.presented)
+	if !reflect.DeepEqual(solver.presented, expected) {
+		t.Errorf("Expected challenges %v to be presented, got %v", expected, solver.presented)
+	}
+
+	solver.presented = nil
+	m.Config.Domains = []string{"example.com"}
+	m.Config.Challenges = []string{acme.ChallengeTypeHTTP01}
+	if _, _, err := m.obtainCertificate(context.Background(), m.Config.Domains); err != nil {
+		t.Fatalf("Failed to obtain certificate with http-01: %s", err)
+	}
+	if expected := []string{"http-01 example.com"}; !reflect.DeepEqual(solver.presented, expected) {
+		t.Errorf("Expected challenges %v to be presented, got %v", expected, solver.presented)
+	}
+}
+
+// waitingSolver records the order in which challenges
+// are presented, waited for and cleaned up.
+type waitingSolver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (s *waitingSolver) record(event string, challenge acme.Challenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event+" "+challenge.Identifier.Value)
+}
+
+func (s *waitingSolver) Present(_ context.Context, challenge acme.Challenge) error {
+	s.record("present", challenge)
+	return nil
+}
+
+func (s *waitingSolver) Wait(_ context.Context, challenge acme.Challenge) error {
+	s.record("wait", challenge)
+	return nil
+}
+
+func (s *waitingSolver) CleanUp(_ context.Context, challenge acme.Challenge) error {
+	s.record("cleanup", challenge)
+	return nil
+}
+
+// count returns how many events of kind were recorded.
+func (s *waitingSolver) count(kind string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, event := range s.events {
+		if strings.HasPrefix(event, kind+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestObtainCertificateParallel(t *testing.T) {
+	srv := newTestACMEServer(t)
+	var inflight, maxInflight int32
+	srv.validateChallenge = func(string) error {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInflight)
+			if n <= seen || atomic.CompareAndSwapInt32(&maxInflight, seen, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	m := newTestManager(t, srv)
+	solver := &waitingSolver{}
+	m.DNS01Solver = solver
+	m.Config.Domains = []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"}
+	m.Config.MaxConcurrentChallenges = 2
+
+	if _, _, err := m.obtainCertificate(context.Background(), m.Config.Domains); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+
+	// every challenge is presented before the first wait
+	for i, event := range solver.events[:len(m.Config.Domains)] {
+		if !strings.HasPrefix(event, "present ") {
+			t.Errorf("Expected event %d to present a challenge, got %s in %v", i, event, solver.events)
+		}
+	}
+	if n := solver.count("cleanup"); n != len(m.Config.Domains) {
+		t.Errorf("Expected %d challenges to be cleaned up, got %d", len(m.Config.Domains), n)
+	}
+	if n := atomic.LoadInt32(&maxInflight); n != 2 {
+		t.Errorf("Expected 2 challenges to be validated at the same time, got %d", n)
+	}
+}
+
+func TestObtainCertificateParallelFailure(t *testing.T) {
+	srv := newTestACMEServer(t)
+	srv.validateChallenge = func(identifier string) error {
+		if identifier == "c.example.com" {
+			return errors.New("TXT record not found")
+		}
+		return nil
+	}
+	m := newTestManager(t, srv)
+	solver := &waitingSolver{}
+	m.DNS01Solver = solver
+	m.Config.Domains = []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}
+
+	_, _, err := m.obtainCertificate(context.Background(), m.Config.Domains)
+	if err == nil || !strings.Contains(err.Error(), "TXT record not found") {
+		t.Fatalf("Expected the failed challenge to fail obtaining the certificate, got: %v", err)
+	}
+	if n := solver.count("cleanup"); n != len(m.Config.Domains) {
+		t.Errorf("Expected all %d challenges to be cleaned up, got %d: %v", len(m.Config.Domains), n, solver.events)
+	}
+}
+
+// cancellingSolver cancels the context of the order while waiting,
+// like Stop does, and records the context error seen by CleanUp.
+type cancellingSolver struct {
+	cancel     context.CancelFunc
+	cleanupErr chan error
+}
+
+func (s *cancellingSolver) Present(context.Context, acme.Challenge) error { return nil }
+
+func (s *cancellingSolver) Wait(ctx context.Context, _ acme.Challenge) error {
+	s.cancel()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *cancellingSolver) CleanUp(ctx context.Context, _ acme.Challenge) error {
+	s.cleanupErr <- ctx.Err()
+	return nil
+}
+
+func TestObtainCertificateCleanUpCancelled(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestManager(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	solver := &cancellingSolver{cancel: cancel, cleanupErr: make(chan error, 1)}
+	m.DNS01Solver = solver
+
+	if _, _, err := m.obtainCertificate(ctx, m.Config.Domains); err == nil {
+		t.Fatal("Expected obtaining the certificate to fail once cancelled")
+	}
+	select {
+	case err := <-solver.cleanupErr:
+		if err != nil {
+			t.Errorf("Expected the challenge to be cleaned up with a live context, got: %v", err)
+		}
+	default:
+		t.Error("Expected the challenge to be cleaned up")
+	}
+}
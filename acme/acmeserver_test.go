@@ -0,0 +1,525 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// testACMEServer is a minimal ACME server to run the client against in tests.
+// It does not verify the signatures of requests, but enforces External
+// Account Binding if eabKeyID is set. Challenges are valid as soon as they
+// are initiated, and certificates are issued by a throwaway CA.
+type testACMEServer struct {
+	*httptest.Server
+
+	eabKeyID string
+	eabKey   []byte
+
+	// certLifetime is the lifetime of issued certificates,
+	// which are valid from now on.
+	certLifetime time.Duration
+	now          func() time.Time
+
+	// challengeTypes are the types of the challenges
+	// offered for each authorization.
+	challengeTypes []string
+
+	// validateChallenge, if set, is called with the identifier of each
+	// initiated challenge, which fails if it returns an error.
+	validateChallenge func(identifier string) error
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	nonce int64
+
+	mu       sync.Mutex
+	accounts map[string]string // compact JWK -> account URL
+	orders   []*testOrder
+	authzs   []*acme.Authorization
+}
+
+// testOrder is an order of the testACMEServer.
+type testOrder struct {
+	acme.Order
+	certPEM []byte
+}
+
+func newTestACMEServer(t *testing.T) *testACMEServer {
+	s := &testACMEServer{
+		accounts:       make(map[string]string),
+		certLifetime:   90 * 24 * time.Hour,
+		now:            time.Now,
+		challengeTypes: []string{acme.ChallengeTypeDNS01},
+	}
+
+	var err error
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.caCert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", s.handleDirectory)
+	mux.HandleFunc("/new-nonce", s.handleNonce)
+	mux.HandleFunc("/new-account", s.handleNewAccount)
+	mux.HandleFunc("/new-order", s.handleNewOrder)
+	mux.HandleFunc("/order/", s.handleOrder)
+	mux.HandleFunc("/authz/", s.handleAuthz)
+	mux.HandleFunc("/chall/", s.handleChallenge)
+	mux.HandleFunc("/finalize/", s.handleFinalize)
+	mux.HandleFunc("/cert/", s.handleCert)
+	s.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testACMEServer) directoryURL() string { return s.URL + "/dir" }
+
+// roots returns a pool that trusts the server's TLS certificate.
+func (s *testACMEServer) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return pool
+}
+
+func (s *testACMEServer) numAccounts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.accounts)
+}
+
+func (s *testACMEServer) numOrders() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.orders)
+}
+
+func (s *testACMEServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.URL + "/new-nonce",
+		"newAccount": s.URL + "/new-account",
+		"newOrder":   s.URL + "/new-order",
+		"revokeCert": s.URL + "/revoke-cert",
+		"keyChange":  s.URL + "/key-change",
+		"meta": map[string]interface{}{
+			"termsOfService":          s.URL + "/terms",
+			"externalAccountRequired": s.eabKeyID != "",
+		},
+	})
+}
+
+func (s *testACMEServer) handleNonce(w http.ResponseWriter, r *http.Request) {
+	s.setNonce(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *testACMEServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	header, payload, err := readTestJWS(r)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var req struct {
+		TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+		ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	jwk, err := compactJSON(header["jwk"])
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "missing jwk")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if location, ok := s.accounts[jwk]; ok {
+		w.Header().Set("Location", location)
+		s.writeJSON(w, http.StatusOK, map[string]string{"status": "valid"})
+		return
+	}
+	if req.OnlyReturnExisting {
+		s.writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "no account for this key")
+		return
+	}
+	if !req.TermsOfServiceAgreed {
+		s.writeProblem(w, http.StatusForbidden, "userActionRequired", "terms of service not agreed")
+		return
+	}
+	if s.eabKeyID != "" {
+		if err := s.verifyEAB(req.ExternalAccountBinding, jwk); err != nil {
+			s.writeProblem(w, http.StatusUnauthorized, "externalAccountRequired", err.Error())
+			return
+		}
+	}
+
+	location := s.URL + "/account/" + strconv.Itoa(len(s.accounts)+1)
+	s.accounts[jwk] = location
+	w.Header().Set("Location", location)
+	s.writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (s *testACMEServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	_, payload, err := readTestJWS(r)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var req struct {
+		Identifiers []acme.Identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "missing identifiers")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strconv.Itoa(len(s.orders))
+	order := &testOrder{Order: acme.Order{
+		Status:      acme.StatusPending,
+		Identifiers: req.Identifiers,
+		Finalize:    s.URL + "/finalize/" + id,
+		Location:    s.URL + "/order/" + id,
+	}}
+	for _, ident := range req.Identifiers {
+		authzID := strconv.Itoa(len(s.authzs))
+		authz := &acme.Authorization{
+			Identifier: ident,
+			Status:     acme.StatusPending,
+		}
+		if strings.HasPrefix(ident.Value, "*.") {
+			authz.Identifier.Value = strings.TrimPrefix(ident.Value, "*.")
+			authz.Wildcard = true
+		}
+		for _, typ := range s.challengeTypes {
+			// wildcards can only be validated with dns-01
+			if authz.Wildcard && typ != acme.ChallengeTypeDNS01 {
+				continue
+			}
+			authz.Challenges = append(authz.Challenges, acme.Challenge{
+				Type:   typ,
+				URL:    s.URL + "/chall/" + authzID + "?type=" + typ,
+				Token:  "token" + authzID,
+				Status: acme.StatusPending,
+			})
+		}
+		s.authzs = append(s.authzs, authz)
+		order.Authorizations = append(order.Authorizations, s.URL+"/authz/"+authzID)
+	}
+	s.orders = append(s.orders, order)
+
+	w.Header().Set("Location", order.Location)
+	s.writeJSON(w, http.StatusCreated, order.Order)
+}
+
+func (s *testACMEServer) handleOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.lookupOrder(r.URL.Path)
+	if order == nil {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, order.Order)
+}
+
+func (s *testACMEServer) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authz := s.lookupAuthz(r.URL.Path)
+	if authz == nil {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "no such authorization")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, authz)
+}
+
+// handleChallenge validates the challenge right away.
+func (s *testACMEServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	authz := s.lookupAuthz(r.URL.Path)
+	s.mu.Unlock()
+	if authz == nil {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	if s.validateChallenge != nil {
+		if err := s.validateChallenge(authz.Identifier.Value); err != nil {
+			s.mu.Lock()
+			authz.Status = acme.StatusInvalid
+			s.mu.Unlock()
+			s.writeProblem(w, http.StatusForbidden, "unauthorized", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, challenge := range authz.Challenges {
+		if challenge.Type == r.URL.Query().Get("type") {
+			authz.Status = acme.StatusValid
+			authz.Challenges[i].Status = acme.StatusValid
+			s.writeJSON(w, http.StatusOK, authz.Challenges[i])
+			return
+		}
+	}
+	s.writeProblem(w, http.StatusNotFound, "malformed", "no such challenge")
+}
+
+func (s *testACMEServer) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	_, payload, err := readTestJWS(r)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.lookupOrder(r.URL.Path)
+	if order == nil {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	for _, authzURL := range order.Authorizations {
+		if authz := s.lookupAuthz(authzURL); authz == nil || authz.Status != acme.StatusValid {
+			s.writeProblem(w, http.StatusForbidden, "orderNotReady", "authorizations are not valid")
+			return
+		}
+	}
+
+	order.certPEM, err = s.issue(csr)
+	if err != nil {
+		s.writeProblem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	order.Status = acme.StatusValid
+	order.Certificate = strings.Replace(order.Location, "/order/", "/cert/", 1)
+	s.writeJSON(w, http.StatusOK, order.Order)
+}
+
+func (s *testACMEServer) handleCert(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.lookupOrder(r.URL.Path)
+	if order == nil || order.certPEM == nil {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "no such certificate")
+		return
+	}
+	s.setNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(order.certPEM)
+}
+
+// issue returns the PEM encoded chain of a certificate for csr.
+func (s *testACMEServer) issue(csr *x509.CertificateRequest) ([]byte, error) {
+	now := s.now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    now,
+		NotAfter:     now.Add(s.certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	return chain, nil
+}
+
+// lookupOrder returns the order with the ID in the last segment of path.
+// s.mu must be held.
+func (s *testACMEServer) lookupOrder(path string) *testOrder {
+	i, err := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+	if err != nil || i < 0 || i >= len(s.orders) {
+		return nil
+	}
+	return s.orders[i]
+}
+
+// lookupAuthz returns the authorization with the ID in the last segment
+// of path. s.mu must be held.
+func (s *testACMEServer) lookupAuthz(path string) *acme.Authorization {
+	i, err := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+	if err != nil || i < 0 || i >= len(s.authzs) {
+		return nil
+	}
+	return s.authzs[i]
+}
+
+// verifyEAB checks that eab binds the account key jwk to the external
+// account of the server, as described in RFC 8555 §7.3.4.
+func (s *testACMEServer) verifyEAB(eab json.RawMessage, jwk string) error {
+	if len(eab) == 0 {
+		return fmt.Errorf("external account binding required")
+	}
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(eab, &jws); err != nil {
+		return err
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return err
+	}
+	if header.Alg != "HS256" || header.KID != s.eabKeyID || header.URL != s.URL+"/new-account" {
+		return fmt.Errorf("unexpected binding header %s", protected)
+	}
+
+	mac := hmac.New(sha256.New, s.eabKey)
+	mac.Write([]byte(jws.Protected + "." + jws.Payload))
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return fmt.Errorf("invalid binding signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	boundKey, err := compactJSON(payload)
+	if err != nil {
+		return err
+	}
+	if boundKey != jwk {
+		return fmt.Errorf("binding is for a different account key")
+	}
+	return nil
+}
+
+func (s *testACMEServer) setNonce(w http.ResponseWriter) {
+	nonce := atomic.AddInt64(&s.nonce, 1)
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(nonce, 10))
+}
+
+func (s *testACMEServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	s.setNonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *testACMEServer) writeProblem(w http.ResponseWriter, status int, typ, detail string) {
+	s.setNonce(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": detail,
+	})
+}
+
+// readTestJWS decodes the flattened JWS in the body of r.
+func readTestJWS(r *http.Request) (map[string]json.RawMessage, []byte, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, nil, err
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, payload, nil
+}
+
+func compactJSON(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("empty JSON")
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
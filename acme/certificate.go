@@ -1,7 +1,100 @@
 package acme
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Certificate struct {
 	tls.Certificate
 }
+
+// CertCache holds the certificate that is served. The certificate can be
+// swapped while serving, it is used from the next handshake on, so
+// established connections are not affected.
+type CertCache struct {
+	cert atomic.Value // *tls.Certificate
+}
+
+// Load returns the cached certificate, or nil if there is none yet.
+func (c *CertCache) Load() *tls.Certificate {
+	cert, _ := c.cert.Load().(*tls.Certificate)
+	return cert
+}
+
+// Store replaces the cached certificate with cert.
+func (c *CertCache) Store(cert *tls.Certificate) {
+	c.cert.Store(cert)
+}
+
+// GetCertificate returns the cached certificate. It
+// can be used as tls.Config.GetCertificate.
+func (c *CertCache) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := c.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate available")
+	}
+	return cert, nil
+}
+
+// FileCertCache is a CertCache for a certificate and key file, which are
+// loaded again on the next handshake after either of them changed on disk.
+type FileCertCache struct {
+	CertCache
+
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewFileCertCache returns a FileCertCache with the certificate
+// and key loaded from certFile and keyFile.
+func NewFileCertCache(certFile, keyFile string) (*FileCertCache, error) {
+	c := &FileCertCache{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the certificate, loading it again if the files
+// changed. If they cannot be loaded, the previous certificate is kept.
+// It can be used as tls.Config.GetCertificate.
+func (c *FileCertCache) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		log.Warningf("Keeping previous certificate: %v", err)
+	}
+	return c.CertCache.GetCertificate(hello)
+}
+
+// reload loads the certificate and key if they changed since they were last loaded.
+func (c *FileCertCache) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS cert: %s", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS cert: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS cert: %s", err)
+	}
+	c.Store(&cert)
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
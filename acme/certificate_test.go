@@ -0,0 +1,168 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestKeyPair returns a PEM encoded self-signed certificate for name and its key.
+func newTestKeyPair(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+func writeTestKeyPair(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	certPEM, keyPEM := newTestKeyPair(t, name)
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedName(t *testing.T, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+	cert, err := getCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestFileCertCache(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Minute)
+
+	writeTestKeyPair(t, certFile, keyFile, "old.example.com", modTime)
+	cache, err := NewFileCertCache(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %s", err)
+	}
+	if name := servedName(t, cache.GetCertificate); name != "old.example.com" {
+		t.Errorf("Expected old.example.com to be served, got %s", name)
+	}
+
+	writeTestKeyPair(t, certFile, keyFile, "new.example.com", modTime.Add(time.Second))
+	if name := servedName(t, cache.GetCertificate); name != "new.example.com" {
+		t.Errorf("Expected changed certificate new.example.com to be served, got %s", name)
+	}
+
+	// a broken certificate does not replace the served one
+	if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cache.GetCertificate); name != "new.example.com" {
+		t.Errorf("Expected new.example.com to be kept, got %s", name)
+	}
+
+	if _, err := NewFileCertCache(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("Expected error for missing certificate file")
+	}
+}
+
+func TestCertCacheSwapKeepsConnections(t *testing.T) {
+	var cache CertCache
+	oldCert, oldKey := newTestKeyPair(t, "old.example.com")
+	cert, err := parseCertificate(oldCert, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Store(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: cache.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		return conn
+	}
+	echo := func(conn *tls.Conn) {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Failed to write: %s", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Failed to read: %s", err)
+		}
+	}
+	peerName := func(conn *tls.Conn) string {
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	established := dial()
+	defer established.Close()
+	echo(established)
+
+	newCert, newKey := newTestKeyPair(t, "new.example.com")
+	cert, err = parseCertificate(newCert, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Store(cert)
+
+	// the established connection keeps working
+	echo(established)
+	if name := peerName(established); name != "old.example.com" {
+		t.Errorf("Expected established connection to use old.example.com, got %s", name)
+	}
+
+	conn := dial()
+	defer conn.Close()
+	if name := peerName(conn); name != "new.example.com" {
+		t.Errorf("Expected new connection to use new.example.com, got %s", name)
+	}
+}
@@ -0,0 +1,33 @@
+package acme
+
+import (
+	ctls "crypto/tls"
+	"net/http"
+
+	"github.com/mariuskimmina/tlsplus/tls"
+	"github.com/mholt/acmez/acme"
+)
+
+// newClient returns an ACME client for the manager's CA. The CA's
+// TLS certificate is verified against Config.TrustedRoots, unless
+// Config.InsecureSkipVerify is set.
+func (m *AcmeManager) newClient() *acme.Client {
+	return &acme.Client{
+		Directory:  m.CA,
+		HTTPClient: &http.Client{Transport: m.httpTransport()},
+	}
+}
+
+// httpTransport returns the transport shared by the manager's ACME clients,
+// so that its idle connections can be closed when the manager is stopped.
+func (m *AcmeManager) httpTransport() *http.Transport {
+	m.transportOnce.Do(func() {
+		tlsConfig := &ctls.Config{RootCAs: m.Config.TrustedRoots}
+		if m.Config.InsecureSkipVerify {
+			log.Warningf("Not verifying the TLS certificate of ACME server %s, this is insecure and meant for testing only!", m.CA)
+			tlsConfig.InsecureSkipVerify = true
+		}
+		m.transport = tls.NewHTTPSTransport(tlsConfig)
+	})
+	return m.transport
+}
@@ -1,22 +1,109 @@
 package acme
 
-import "time"
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"time"
+)
 
 type Config struct {
 	RenewalWindowRatio float64
 
 	RenewCheckInterval time.Duration
 
-	ServerName string
+	// Domains are the names the certificate is obtained for,
+	// each of them ends up as a SAN on the certificate.
+	Domains []string
 
+	// CA is the URL of the ACME directory
+	// certificates are obtained from.
+	CA string
+
+	// Email is the contact address of the ACME account,
+	// the CA sends expiration notices to it.
+	Email string
+
+	// AgreeTOS is whether the operator agreed to the CA's terms
+	// of service, no account is registered without it.
+	AgreeTOS bool
+
+	// EABKeyID and EABHMACKey are the credentials for External
+	// Account Binding, which some CAs require to register an account.
+	// The HMAC key is base64url encoded, as handed out by the CA.
+	EABKeyID   string
+	EABHMACKey string
+
+	// TrustedRoots is the pool of root certificates used to verify
+	// the CA's TLS certificate. If nil, system CAs are used.
+	TrustedRoots *x509.CertPool
+
+	// InsecureSkipVerify disables verification of the CA's TLS
+	// certificate. It must only be used for testing.
+	InsecureSkipVerify bool
+
+	// Challenges are the types of the challenges that may be solved,
+	// in order of preference. The first one offered by the CA is solved.
+	Challenges []string
+
+	// HTTPChallengeAddr is the address the http-01
+	// challenges are served on.
+	HTTPChallengeAddr string
+
+	// LocalDNSAddr is the address CoreDNS serves plain DNS on,
+	// it is queried to check that challenges are published.
+	LocalDNSAddr string
+
+	// PropagationTimeout is how long to wait for the TXT
+	// record of a dns-01 challenge to be published.
+	PropagationTimeout time.Duration
+
+	// DNSProvider publishes the TXT records of dns-01 challenges
+	// at a DNS hosting service. If nil, they are served by CoreDNS.
+	DNSProvider DNSProvider
+
+	// MaxConcurrentChallenges is how many challenges are initiated
+	// and polled at the same time while obtaining a certificate.
+	MaxConcurrentChallenges int
+
+	// CheckNameservers is whether to wait until all authoritative
+	// nameservers of the zone publish the TXT record of a challenge.
+	CheckNameservers bool
+
+	// Storage holds the accounts, certificates and their metadata,
+	// namespaced per CA. If nil, a FileStorage in the user's data
+	// directory is used.
 	Storage Storage
 }
 
-func NewConfig(serverName string, storage Storage) *Config {
+func NewConfig(domains []string, storage Storage) *Config {
 	return &Config{
-		RenewCheckInterval: DefaultRenewCheckInterval,
-		RenewalWindowRatio: DefaultRenewalWindowRatio,
-		ServerName:         serverName,
-		Storage:            storage,
+		RenewCheckInterval:      DefaultRenewCheckInterval,
+		RenewalWindowRatio:      DefaultRenewalWindowRatio,
+		Domains:                 domains,
+		CA:                      DefaultCA,
+		Challenges:              append([]string(nil), DefaultChallenges...),
+		HTTPChallengeAddr:       DefaultHTTPChallengeAddr,
+		LocalDNSAddr:            "127.0.0.1:53",
+		PropagationTimeout:      DefaultPropagationTimeout,
+		MaxConcurrentChallenges: DefaultMaxConcurrentChallenges,
+		Storage:                 storage,
+	}
+}
+
+// CADirectoryURL returns the ACME directory URL for ca, which is
+// either one of the well-known shortcuts (letsencrypt,
+// letsencrypt-staging, zerossl) or an https URL.
+func CADirectoryURL(ca string) (string, error) {
+	if dir, ok := wellKnownCAs[ca]; ok {
+		return dir, nil
+	}
+	u, err := url.Parse(ca)
+	if err != nil {
+		return "", fmt.Errorf("invalid CA %q: %v", ca, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid CA %q: must be a well-known CA name or an https URL", ca)
 	}
+	return u.String(), nil
 }
@@ -1,6 +1,10 @@
 package acme
 
-import "time"
+import (
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
 
 const (
 	// DefaultRenewCheckInterval is how often to check certificates for expiration.
@@ -14,4 +18,37 @@ const (
 	// certificate's validity period in which it should be renewed. A default value
 	// of ~1/3 is pretty safe and recommended for most certificates.
 	DefaultRenewalWindowRatio = 1.0 / 3.0
+
+	// DefaultPropagationTimeout is how long to wait for the TXT
+	// record of a dns-01 challenge to be published.
+	DefaultPropagationTimeout = 2 * time.Minute
+
+	// DefaultHTTPChallengeAddr is the address http-01 challenges
+	// are served on, the CA requests them on port 80.
+	DefaultHTTPChallengeAddr = ":80"
+
+	// DefaultMaxConcurrentChallenges is how many challenges are initiated
+	// and polled at the same time, which bounds the requests to the CA.
+	DefaultMaxConcurrentChallenges = 10
 )
+
+// DefaultChallenges are the challenge types solved when none are configured.
+var DefaultChallenges = []string{acme.ChallengeTypeDNS01}
+
+// Directory URLs of well-known ACME CAs.
+const (
+	LetsEncryptProductionCA = "https://acme-v02.api.letsencrypt.org/directory"
+	LetsEncryptStagingCA    = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	ZeroSSLProductionCA     = "https://acme.zerossl.com/v2/DV90"
+)
+
+// DefaultCA is the ACME directory used when no CA is configured.
+const DefaultCA = LetsEncryptProductionCA
+
+// wellKnownCAs maps the shortcuts accepted by the ca directive
+// to the directory URL of the CA they stand for.
+var wellKnownCAs = map[string]string{
+	"letsencrypt":         LetsEncryptProductionCA,
+	"letsencrypt-staging": LetsEncryptStagingCA,
+	"zerossl":             ZeroSSLProductionCA,
+}
@@ -0,0 +1,143 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+// DNSProvider is a libdns provider that can publish the
+// TXT records of dns-01 challenges at a DNS hosting service.
+type DNSProvider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// DNSProviderSolver solves dns-01 challenges by publishing the TXT records
+// with a DNSProvider, for when CoreDNS is not the authoritative server of
+// the zone and DNSSolver cannot be used. Like DNSSolver, it publishes the
+// records at the end of the CNAME chain of the record name.
+type DNSProviderSolver struct {
+	Provider DNSProvider
+
+	// Resolver is the address of the DNS server the zones and
+	// nameservers of the challenge records are looked up at.
+	Resolver string
+
+	// PropagationTimeout is how long Wait waits for the TXT
+	// record to be published by all authoritative nameservers.
+	PropagationTimeout time.Duration
+
+	// nameserverPort is the port nameservers are queried on.
+	nameserverPort string
+
+	// records are the records appended by Present, by the
+	// challenge they were appended for, for CleanUp to delete.
+	recordsMu sync.Mutex
+	records   map[string]providerRecords
+}
+
+// providerRecords are records appended to zone by a DNSProvider
+// for the TXT record name.
+type providerRecords struct {
+	name    string
+	zone    string
+	records []libdns.Record
+}
+
+// challengeRecordTTL is the TTL of the TXT records of challenges, which
+// are short-lived and looked up by the CA shortly after they are published.
+const challengeRecordTTL = time.Minute
+
+// Present publishes the TXT record of the challenge in its zone.
+func (s *DNSProviderSolver) Present(ctx context.Context, challenge acme.Challenge) error {
+	name, err := followCNAMEs(ctx, s.Resolver, challengeRecordName(challenge))
+	if err != nil {
+		return err
+	}
+	zone, err := findZone(ctx, s.Resolver, name)
+	if err != nil {
+		return err
+	}
+	record := libdns.Record{
+		Type:  "TXT",
+		Name:  libdns.RelativeName(name, zone),
+		Value: challenge.DNS01KeyAuthorization(),
+		TTL:   challengeRecordTTL,
+	}
+	appended, err := s.Provider.AppendRecords(ctx, zone, []libdns.Record{record})
+	if err != nil {
+		return fmt.Errorf("publishing TXT record %s in zone %s: %v", name, zone, err)
+	}
+	if len(appended) == 0 {
+		appended = []libdns.Record{record}
+	}
+
+	s.recordsMu.Lock()
+	defer s.recordsMu.Unlock()
+	if s.records == nil {
+		s.records = make(map[string]providerRecords)
+	}
+	s.records[challengeKey(challenge)] = providerRecords{name: name, zone: zone, records: appended}
+	return nil
+}
+
+// Wait blocks until all authoritative nameservers of the zone serve the
+// TXT record of the challenge, or until PropagationTimeout or ctx is done.
+func (s *DNSProviderSolver) Wait(ctx context.Context, challenge acme.Challenge) error {
+	name := challengeRecordName(challenge)
+	s.recordsMu.Lock()
+	if appended, ok := s.records[challengeKey(challenge)]; ok {
+		name = appended.name
+	}
+	s.recordsMu.Unlock()
+
+	d := &DNSSolver{
+		Addr:               s.Resolver,
+		PropagationTimeout: s.PropagationTimeout,
+		nameserverPort:     s.nameserverPort,
+		nameserversOnly:    true,
+	}
+	return d.waitPublished(ctx, name, challenge.DNS01KeyAuthorization())
+}
+
+// CleanUp deletes the TXT record of the challenge.
+func (s *DNSProviderSolver) CleanUp(ctx context.Context, challenge acme.Challenge) error {
+	key := challengeKey(challenge)
+	s.recordsMu.Lock()
+	appended, ok := s.records[key]
+	delete(s.records, key)
+	s.recordsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	if _, err := s.Provider.DeleteRecords(ctx, appended.zone, appended.records); err != nil {
+		return fmt.Errorf("deleting TXT record %s: %v", appended.name, err)
+	}
+	return nil
+}
+
+// findZone returns the zone name is in, which is the closest enclosing
+// name with an SOA record, as looked up at resolver.
+func findZone(ctx context.Context, resolver, name string) (string, error) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		m := new(dns.Msg)
+		m.SetQuestion(name[off:], dns.TypeSOA)
+		r, err := exchange(ctx, resolver, m)
+		if err != nil {
+			return "", fmt.Errorf("looking up zone of %s: %v", name, err)
+		}
+		for _, rr := range r.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name[off:]) {
+				return dns.CanonicalName(soa.Hdr.Name), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no zone found for %s", name)
+}
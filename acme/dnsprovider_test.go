@@ -0,0 +1,183 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+// testProvider is a DNSProvider hosting the records in memory.
+type testProvider struct {
+	mu      sync.Mutex
+	records map[string]libdns.Record // by absolute name
+}
+
+func (p *testProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.records == nil {
+		p.records = make(map[string]libdns.Record)
+	}
+	for _, rec := range recs {
+		p.records[libdns.AbsoluteName(rec.Name, zone)] = rec
+	}
+	return recs, nil
+}
+
+func (p *testProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rec := range recs {
+		delete(p.records, libdns.AbsoluteName(rec.Name, zone))
+	}
+	return recs, nil
+}
+
+func (p *testProvider) lookup(name string) (libdns.Record, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rec, ok := p.records[name]
+	return rec, ok
+}
+
+// ServeDNS answers for the zone example.com hosted by p, with the nameservers
+// ns1.example.com at 127.0.0.1 and ns2.example.com at 127.0.0.2. The challenges
+// of delegated.example.com are delegated by CNAME to delegated.auth.example.com.
+func (p *testProvider) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	soa := test.SOA("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600")
+	switch {
+	case q.Qtype == dns.TypeSOA && q.Name == "example.com.":
+		m.Answer = append(m.Answer, soa)
+	case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+		m.Answer = append(m.Answer,
+			test.NS("example.com. 3600 IN NS ns1.example.com."),
+			test.NS("example.com. 3600 IN NS ns2.example.com."),
+		)
+	case q.Qtype == dns.TypeA && q.Name == "ns1.example.com.":
+		m.Answer = append(m.Answer, test.A("ns1.example.com. 3600 IN A 127.0.0.1"))
+	case q.Qtype == dns.TypeA && q.Name == "ns2.example.com.":
+		m.Answer = append(m.Answer, test.A("ns2.example.com. 3600 IN A 127.0.0.2"))
+	case q.Qtype == dns.TypeCNAME && q.Name == "_acme-challenge.delegated.example.com.":
+		m.Answer = append(m.Answer, test.CNAME("_acme-challenge.delegated.example.com. 3600 IN CNAME delegated.auth.example.com."))
+	default:
+		if rec, ok := p.lookup(q.Name); ok && q.Qtype == dns.TypeTXT {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(rec.TTL / time.Second)}
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{rec.Value}})
+		} else {
+			m.Ns = append(m.Ns, soa)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestDNSProviderSolver(t *testing.T) {
+	provider := &testProvider{}
+	addr := newTestDNSServer(t, "127.0.0.1:0", provider.ServeDNS)
+	_, port, _ := net.SplitHostPort(addr)
+	newTestDNSServer(t, net.JoinHostPort("127.0.0.2", port), provider.ServeDNS)
+
+	solver := &DNSProviderSolver{
+		Provider:           provider,
+		Resolver:           addr,
+		PropagationTimeout: 5 * time.Second,
+		nameserverPort:     port,
+	}
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "dns.example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	ctx := context.Background()
+
+	if err := solver.Present(ctx, challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	rec, ok := provider.lookup("_acme-challenge.dns.example.com.")
+	if !ok || rec.Name != "_acme-challenge.dns" || rec.Value != challenge.DNS01KeyAuthorization() {
+		t.Errorf("Expected TXT record in zone example.com, got %+v", rec)
+	}
+	if err := solver.Wait(ctx, challenge); err != nil {
+		t.Errorf("Expected presented challenge to be published, got: %s", err)
+	}
+
+	if err := solver.CleanUp(ctx, challenge); err != nil {
+		t.Fatalf("Failed to clean up challenge: %s", err)
+	}
+	if _, ok := provider.lookup("_acme-challenge.dns.example.com."); ok {
+		t.Errorf("Expected TXT record to be deleted")
+	}
+}
+
+func TestDNSProviderSolverCNAME(t *testing.T) {
+	provider := &testProvider{}
+	addr := newTestDNSServer(t, "127.0.0.1:0", provider.ServeDNS)
+	_, port, _ := net.SplitHostPort(addr)
+	newTestDNSServer(t, net.JoinHostPort("127.0.0.2", port), provider.ServeDNS)
+
+	solver := &DNSProviderSolver{
+		Provider:           provider,
+		Resolver:           addr,
+		PropagationTimeout: 5 * time.Second,
+		nameserverPort:     port,
+	}
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "delegated.example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	ctx := context.Background()
+
+	if err := solver.Present(ctx, challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	rec, ok := provider.lookup("delegated.auth.example.com.")
+	if !ok || rec.Name != "delegated.auth" {
+		t.Errorf("Expected TXT record at the CNAME target, got %+v", rec)
+	}
+	if err := solver.Wait(ctx, challenge); err != nil {
+		t.Errorf("Expected presented challenge to be published, got: %s", err)
+	}
+
+	if err := solver.CleanUp(ctx, challenge); err != nil {
+		t.Fatalf("Failed to clean up challenge: %s", err)
+	}
+	if _, ok := provider.lookup("delegated.auth.example.com."); ok {
+		t.Errorf("Expected TXT record to be deleted")
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	provider := &testProvider{}
+	addr := newTestDNSServer(t, "127.0.0.1:0", provider.ServeDNS)
+
+	tests := []struct {
+		name         string
+		expectedZone string // empty if there is no zone
+	}{
+		{"_acme-challenge.example.com.", "example.com."},
+		{"_acme-challenge.dns.example.com.", "example.com."},
+		{"example.com.", "example.com."},
+		{"_acme-challenge.example.org.", ""},
+	}
+
+	for i, test := range tests {
+		zone, err := findZone(context.Background(), addr, test.name)
+		if test.expectedZone == "" {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got zone %s", i, zone)
+			}
+			continue
+		}
+		if err != nil || zone != test.expectedZone {
+			t.Errorf("Test %d: Expected zone %s, got %s: %v", i, test.expectedZone, zone, err)
+		}
+	}
+}
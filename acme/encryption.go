@@ -0,0 +1,166 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedMagic prefixes encrypted values, values without
+// it are plaintext stored before encryption was enabled.
+var encryptedMagic = []byte("coredns-tls-aes-gcm-v1\n")
+
+// EncryptionKeySize is the size of the AES-256 key of an EncryptedStorage.
+const EncryptionKeySize = 32
+
+// EncryptedStorage is a Storage that encrypts all values with AES-GCM before
+// they are stored by the wrapped Storage. The storage key is authenticated
+// along with each value, so values cannot be moved between keys unnoticed.
+// Plaintext values are still loaded, so that encryption can be enabled for
+// an existing storage, Migrate encrypts them.
+type EncryptedStorage struct {
+	Storage
+
+	aead cipher.AEAD
+}
+
+// NewEncryptedStorage returns an EncryptedStorage that wraps storage and
+// encrypts with key, which must be EncryptionKeySize bytes long.
+func NewEncryptedStorage(storage Storage, key []byte) (*EncryptedStorage, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStorage{Storage: storage, aead: aead}, nil
+}
+
+// ParseEncryptionKey decodes a base64 encoded encryption key.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if key, err := encoding.DecodeString(encoded); err == nil {
+			if len(key) != EncryptionKeySize {
+				return nil, fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+			}
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("encryption key must be base64 encoded")
+}
+
+// Store encrypts value and saves it at key.
+func (s *EncryptedStorage) Store(ctx context.Context, key string, value []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append(append([]byte(nil), encryptedMagic...), nonce...)
+	sealed = s.aead.Seal(sealed, nonce, value, []byte(key))
+	return s.Storage.Store(ctx, key, sealed)
+}
+
+// Load retrieves the value at key and decrypts it.
+// A plaintext value is returned as is.
+func (s *EncryptedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.Storage.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(value, encryptedMagic) {
+		return value, nil
+	}
+	return s.decrypt(key, value)
+}
+
+// Stat returns information about key. The size of a value is the size of
+// its plaintext, which is told by the size of the encrypted value, as
+// encryption adds the same overhead to every value.
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	info, err := s.Storage.Stat(ctx, key)
+	if err != nil || !info.IsTerminal {
+		return info, err
+	}
+	value, err := s.Storage.Load(ctx, key)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	info.Size = int64(len(value))
+	if bytes.HasPrefix(value, encryptedMagic) {
+		info.Size -= int64(len(encryptedMagic) + s.aead.NonceSize() + s.aead.Overhead())
+	}
+	return info, nil
+}
+
+// decrypt returns the plaintext of the encrypted value at key.
+func (s *EncryptedStorage) decrypt(key string, value []byte) ([]byte, error) {
+	value = value[len(encryptedMagic):]
+	if len(value) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting %s: value too short", key)
+	}
+	nonce, ciphertext := value[:s.aead.NonceSize()], value[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", key, err)
+	}
+	return plaintext, nil
+}
+
+// Migrate encrypts all plaintext values in storage. It is safe to run
+// repeatedly, values that are encrypted already are left alone.
+func (s *EncryptedStorage) Migrate(ctx context.Context) error {
+	lockKey := "encryption_migration"
+	if err := s.Lock(ctx, lockKey); err != nil {
+		return fmt.Errorf("locking storage: %v", err)
+	}
+	defer s.Unlock(ctx, lockKey)
+
+	for _, prefix := range []string{"acme", "certificates"} {
+		if !s.Exists(ctx, prefix) {
+			continue
+		}
+		keys, err := s.List(ctx, prefix, true)
+		if err != nil {
+			return fmt.Errorf("listing %s: %v", prefix, err)
+		}
+		for _, key := range keys {
+			info, err := s.Storage.Stat(ctx, key)
+			if err != nil {
+				return err
+			}
+			if !info.IsTerminal {
+				continue
+			}
+			value, err := s.Storage.Load(ctx, key)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(value, encryptedMagic) {
+				continue
+			}
+			log.Infof("Encrypting %s", key)
+			if err := s.Store(ctx, key, value); err != nil {
+				return fmt.Errorf("encrypting %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *EncryptedStorage) String() string {
+	return fmt.Sprintf("encrypted:%v", s.Storage)
+}
+
+// Interface guard
+var _ Storage = (*EncryptedStorage)(nil)
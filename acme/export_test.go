@@ -0,0 +1,9 @@
+package acme
+
+import "testing"
+
+// ShortenLockPollInterval lets the tests of package acme_test
+// shorten the lock poll interval of FileStorage.
+func ShortenLockPollInterval(t *testing.T) {
+	shortenLockPollInterval(t)
+}
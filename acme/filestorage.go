@@ -6,15 +6,22 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 )
 
 type FileStorage struct {
 	Path string
+
+	// held maps the lock files held by s to channels
+	// that stop keeping them fresh when closed.
+	heldMu sync.Mutex
+	held   map[string]chan struct{}
 }
 
 func NewFileStorage(path string) *FileStorage {
@@ -29,24 +36,42 @@ func (s *FileStorage) Exists(_ context.Context, key string) bool {
 	return !errors.Is(err, fs.ErrNotExist)
 }
 
-// Store saves value at key.
+// Store saves value at key. The value is written to a temporary
+// file first, so that a reader never sees a partially written value.
 func (s *FileStorage) Store(_ context.Context, key string, value []byte) error {
 	filename := s.Filename(key)
 	err := os.MkdirAll(filepath.Dir(filename), 0700)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, value, 0600)
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
 }
 
-// Load retrieves the value at key.
+// Load retrieves the value at key. The error satisfies
+// errors.Is(err, fs.ErrNotExist) if key does not exist.
 func (s *FileStorage) Load(_ context.Context, key string) ([]byte, error) {
 	return os.ReadFile(s.Filename(key))
 }
 
 // Delete deletes the value at key.
 func (s *FileStorage) Delete(_ context.Context, key string) error {
-	return os.Remove(s.Filename(key))
+	err := os.Remove(s.Filename(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
 }
 
 // List returns all keys that match prefix.
@@ -84,8 +109,17 @@ func (s *FileStorage) List(ctx context.Context, prefix string, recursive bool) (
 }
 
 // Stat returns information about key.
-func (s *FileStorage) Stat(_ context.Context, key string) error {
-	return nil
+func (s *FileStorage) Stat(_ context.Context, key string) (KeyInfo, error) {
+	info, err := os.Stat(s.Filename(key))
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return KeyInfo{
+		Key:        key,
+		Modified:   info.ModTime(),
+		Size:       info.Size(),
+		IsTerminal: !info.IsDir(),
+	}, nil
 }
 
 // Filename returns the key as a path on the file
@@ -96,12 +130,185 @@ func (s *FileStorage) Filename(key string) string {
 
 // Lock obtains a lock named by the given key. It blocks
 // until the lock can be obtained or an error is returned.
+// The lock is a file that is kept fresh while it is held,
+// a lock file that is not is considered stale and taken over.
 func (s *FileStorage) Lock(ctx context.Context, key string) error {
-	return nil
+	filename := s.lockFilename(key)
+	for {
+		err := atomicallyCreateFile(filename, true)
+		if err == nil {
+			s.keepLockfileFresh(filename)
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("creating lock file: %v", err)
+		}
+
+		// the lock is held, unless it is stale
+		meta, err := readLockfile(filename)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// it has just been released
+			continue
+		case err != nil:
+			return fmt.Errorf("reading lock file: %v", err)
+		case fileLockIsStale(meta):
+			// another process may be taking it over as well, so
+			// it is not retried right away but after polling
+			log.Infof("Lock for '%s' is stale (created: %s, last update: %s), taking it over", key, meta.Created, meta.Updated)
+			if err := removeStaleLockfile(filename); err != nil {
+				return fmt.Errorf("removing stale lock file: %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(fileLockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 // Unlock releases the lock for name.
 func (s *FileStorage) Unlock(_ context.Context, key string) error {
+	filename := s.lockFilename(key)
+	s.heldMu.Lock()
+	if done, ok := s.held[filename]; ok {
+		close(done)
+		delete(s.held, filename)
+	}
+	s.heldMu.Unlock()
+
+	err := os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// lockFilename returns the name of the lock file for key. The key is
+// escaped reversibly, so that different keys never share a lock file.
+func (s *FileStorage) lockFilename(key string) string {
+	return filepath.Join(s.Path, "locks", url.PathEscape(key)+".lock")
+}
+
+// keepLockfileFresh updates the timestamp of the lock file every
+// lockFreshnessInterval in the background, until it is unlocked.
+func (s *FileStorage) keepLockfileFresh(filename string) {
+	done := make(chan struct{})
+	s.heldMu.Lock()
+	if s.held == nil {
+		s.held = make(map[string]chan struct{})
+	}
+	s.held[filename] = done
+	s.heldMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(lockFreshnessInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := updateLockfileFreshness(filename); err != nil {
+					log.Errorf("Keeping lock file %s fresh: %v", filename, err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// readLockfile returns the metadata written into the lock file.
+func readLockfile(filename string) (lockMeta, error) {
+	var meta lockMeta
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		// the lock file may be read while it is created or updated,
+		// in which case it was just modified, or it was left behind
+		// half written, in which case it becomes stale eventually
+		info, err := os.Stat(filename)
+		if err != nil {
+			return meta, err
+		}
+		return lockMeta{Updated: info.ModTime()}, nil
+	}
+	return meta, nil
+}
+
+// updateLockfileFreshness sets the updated timestamp of the lock file to now.
+func updateLockfileFreshness(filename string) error {
+	meta, err := readLockfile(filename)
+	if err != nil {
+		return err
+	}
+	meta.Updated = time.Now()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// see https://github.com/caddyserver/caddy/issues/3954
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fileLockIsStale returns true if the lock has not been kept fresh. As it
+// is updated every lockFreshnessInterval, a grace period is added for
+// the file to be read and written, and for clock skew between machines.
+func fileLockIsStale(meta lockMeta) bool {
+	ref := meta.Updated
+	if ref.IsZero() {
+		ref = meta.Created
+	}
+	return time.Since(ref) > 2*lockFreshnessInterval
+}
+
+// removeStaleLockfile removes the lock file if it is still stale. Takeovers
+// are guarded by an .unlock file, so that a lock that was just taken over
+// by someone else is not removed as well.
+func removeStaleLockfile(filename string) error {
+	guard := filename + ".unlock"
+	if err := atomicallyCreateFile(guard, false); err != nil {
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		// someone else is taking the lock over, unless they crashed doing so
+		if info, err := os.Stat(guard); err == nil && time.Since(info.ModTime()) > 2*lockFreshnessInterval {
+			os.Remove(guard)
+		}
+		return nil
+	}
+	defer os.Remove(guard)
+
+	meta, err := readLockfile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fileLockIsStale(meta) {
+		return nil
+	}
+	err = os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 	return nil
 }
 
@@ -155,6 +362,11 @@ func homeDir() string {
 	return home
 }
 
+// DefaultStorage returns the FileStorage in the user's data directory.
+func DefaultStorage() Storage {
+	return NewFileStorage(dataDir())
+}
+
 func dataDir() string {
 	baseDir := filepath.Join(homeDir(), ".local", "share")
 	if xdgData := os.Getenv("XDG_DATA_HOME"); xdgData != "" {
@@ -177,8 +389,9 @@ type lockMeta struct {
 const lockFreshnessInterval = 5 * time.Second
 
 // fileLockPollInterval is how frequently
-// to check the existence of a lock file
-const fileLockPollInterval = 1 * time.Second
+// to check the existence of a lock file.
+// It is a variable so tests can shorten it.
+var fileLockPollInterval = 1 * time.Second
 
 // Interface guard
 var _ Storage = (*FileStorage)(nil)
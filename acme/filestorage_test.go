@@ -0,0 +1,334 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shortenLockPollInterval makes waiting for a lock fast for the duration of the test.
+func shortenLockPollInterval(t *testing.T) {
+	interval := fileLockPollInterval
+	fileLockPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { fileLockPollInterval = interval })
+}
+
+func TestFileStorageLockGoroutines(t *testing.T) {
+	shortenLockPollInterval(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	const goroutines, iterations = 50, 5
+	var inside int32
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every goroutine has its own storage, like separate instances sharing a directory
+			s := NewFileStorage(dir)
+			for j := 0; j < iterations; j++ {
+				if err := s.Lock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to lock: %s", err)
+					return
+				}
+				if n := atomic.AddInt32(&inside, 1); n != 1 {
+					t.Errorf("Expected only one holder of the lock, got %d", n)
+				}
+				counter++
+				atomic.AddInt32(&inside, -1)
+				if err := s.Unlock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to unlock: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != goroutines*iterations {
+		t.Errorf("Expected counter %d, got %d", goroutines*iterations, counter)
+	}
+}
+
+// TestFileStorageLockHelperProcess is run by TestFileStorageLockProcesses
+// in other processes. It increments the counter in a file under the lock.
+func TestFileStorageLockHelperProcess(t *testing.T) {
+	dir := os.Getenv("FILESTORAGE_LOCK_HELPER_DIR")
+	if dir == "" {
+		t.Skip("only run as helper process")
+	}
+	shortenLockPollInterval(t)
+	s := NewFileStorage(dir)
+	ctx := context.Background()
+	iterations, _ := strconv.Atoi(os.Getenv("FILESTORAGE_LOCK_HELPER_ITERATIONS"))
+
+	for i := 0; i < iterations; i++ {
+		if err := s.Lock(ctx, "counter"); err != nil {
+			t.Fatalf("Failed to lock: %s", err)
+		}
+		data, err := s.Load(ctx, "counter")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Failed to load counter: %s", err)
+		}
+		n, _ := strconv.Atoi(string(data))
+		if err := s.Store(ctx, "counter", []byte(strconv.Itoa(n+1))); err != nil {
+			t.Fatalf("Failed to store counter: %s", err)
+		}
+		if err := s.Unlock(ctx, "counter"); err != nil {
+			t.Fatalf("Failed to unlock: %s", err)
+		}
+	}
+}
+
+func TestFileStorageLockProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	dir := t.TempDir()
+	const processes, iterations = 8, 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFileStorageLockHelperProcess$")
+		cmd.Env = append(os.Environ(),
+			"FILESTORAGE_LOCK_HELPER_DIR="+dir,
+			"FILESTORAGE_LOCK_HELPER_ITERATIONS="+strconv.Itoa(iterations),
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("Helper process failed: %s\n%s", err, out)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := NewFileStorage(dir).Load(context.Background(), "counter")
+	if err != nil {
+		t.Fatalf("Failed to load counter: %s", err)
+	}
+	if expected := strconv.Itoa(processes * iterations); string(data) != expected {
+		t.Errorf("Expected counter %s, got %s", expected, data)
+	}
+}
+
+func TestFileStorageLockStale(t *testing.T) {
+	shortenLockPollInterval(t)
+	s := NewFileStorage(t.TempDir())
+
+	tests := []struct {
+		content   string
+		modTime   time.Time
+		shouldErr bool
+	}{
+		// stale locks are taken over
+		{fmt.Sprintf(`{"created":%q,"updated":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339), time.Now().Add(-time.Hour).Format(time.RFC3339)), time.Now(), false},
+		{fmt.Sprintf(`{"created":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339)), time.Now(), false},
+		{"broken", time.Now().Add(-time.Hour), false},
+		// fresh ones are not
+		{fmt.Sprintf(`{"created":%q,"updated":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339), time.Now().Format(time.RFC3339)), time.Now(), true},
+		{"broken", time.Now(), true},
+	}
+
+	for i, test := range tests {
+		filename := s.lockFilename("stale")
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, test.modTime, test.modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		err := s.Lock(ctx, "stale")
+		cancel()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected lock not to be taken over", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected stale lock to be taken over, got: %s", i, err)
+		}
+		if err := s.Unlock(context.Background(), "stale"); err != nil {
+			t.Fatalf("Test %d: Failed to unlock: %s", i, err)
+		}
+	}
+}
+
+func TestFileStorageLockStaleGuard(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+
+	// a stale lock that another process is taking over
+	filename := s.lockFilename("stale")
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename+".unlock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Lock(ctx, "stale") }()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected waiting for the lock to be cancelled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Lock to return once the context is cancelled")
+	}
+}
+
+func TestFileStorageLockFilename(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	keys := []string{"a/b", "a_b", "A/b", "a%2Fb"}
+	seen := make(map[string]string)
+	for _, key := range keys {
+		filename := s.lockFilename(key)
+		if other, ok := seen[filename]; ok {
+			t.Errorf("Expected keys %s and %s not to share the lock file %s", key, other, filename)
+		}
+		seen[filename] = key
+		if filepath.Dir(filename) != filepath.Join(s.Path, "locks") {
+			t.Errorf("Expected the lock file of %s in the locks directory, got %s", key, filename)
+		}
+	}
+
+	// the locks of different keys are held at the same time
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, key := range keys {
+		if err := s.Lock(ctx, key); err != nil {
+			t.Fatalf("Failed to lock %s: %s", key, err)
+		}
+	}
+	for _, key := range keys {
+		if err := s.Unlock(ctx, key); err != nil {
+			t.Fatalf("Failed to unlock %s: %s", key, err)
+		}
+	}
+}
+
+func TestFileStorageLockContext(t *testing.T) {
+	shortenLockPollInterval(t)
+	dir := t.TempDir()
+	holder, waiter := NewFileStorage(dir), NewFileStorage(dir)
+
+	if err := holder.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := waiter.Lock(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected waiting for the lock to be cancelled, got: %v", err)
+	}
+
+	// once released, the lock can be obtained
+	if err := holder.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+	if err := waiter.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock released lock: %s", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+}
+
+func TestFileStorageLockFreshness(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	ctx := context.Background()
+	if err := s.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+	filename := s.lockFilename("key")
+
+	// pretend the lock was last updated long ago
+	old := lockMeta{Created: time.Now().Add(-time.Hour), Updated: time.Now().Add(-time.Hour)}
+	data, _ := json.Marshal(old)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateLockfileFreshness(filename); err != nil {
+		t.Fatalf("Failed to update lock file: %s", err)
+	}
+	meta, err := readLockfile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %s", err)
+	}
+	if fileLockIsStale(meta) || !meta.Created.Equal(old.Created) {
+		t.Errorf("Expected fresh lock created at %s, got %+v", old.Created, meta)
+	}
+
+	if err := s.Unlock(ctx, "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected lock file to be removed, got: %v", err)
+	}
+	if len(s.held) != 0 {
+		t.Errorf("Expected lock not to be kept fresh after unlocking")
+	}
+}
+
+func TestFileStorageStat(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	ctx := context.Background()
+	if err := s.Store(ctx, "certificates/example.com/example.com.crt", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key          string
+		shouldErr    bool
+		expectedSize int64
+		terminal     bool
+	}{
+		{"certificates/example.com/example.com.crt", false, int64(len("certificate")), true},
+		{"certificates/example.com", false, -1, false},
+		{"certificates/missing", true, 0, false},
+	}
+
+	for i, test := range tests {
+		info, err := s.Stat(ctx, test.key)
+		if test.shouldErr {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Test %d: Expected not exist error, got: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %s", i, err)
+			continue
+		}
+		if info.Key != test.key || info.IsTerminal != test.terminal || info.Modified.IsZero() {
+			t.Errorf("Test %d: Unexpected key info %+v", i, info)
+		}
+		if test.expectedSize >= 0 && info.Size != test.expectedSize {
+			t.Errorf("Test %d: Expected size %d, got %d", i, test.expectedSize, info.Size)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package acme
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ChallengeHandler is the handler of the tls plugin in the CoreDNS plugin chain.
+// It answers the TXT queries for the dns-01 challenges that are presented by
+// DNSSolver and passes all other queries on to the next plugin. That way the
+// challenges are served on all ports and transports CoreDNS listens on. The
+// records are answered at the names DNSSolver published them at, which are
+// the CNAME targets of delegated _acme-challenge names.
+type ChallengeHandler struct {
+	Next plugin.Handler
+}
+
+// ServeDNS implements the plugin.Handler interface.
+func (h ChallengeHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	if state.QType() != dns.TypeTXT || presentedChallenges.empty() {
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+	values := presentedChallenges.lookup(state.Name())
+	if len(values) == 0 {
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+	for _, value := range values {
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{value}})
+	}
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// Name implements the plugin.Handler interface.
+func (h ChallengeHandler) Name() string { return "tls" }
@@ -0,0 +1,70 @@
+package acme
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+func TestChallengeHandler(t *testing.T) {
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	solver := &DNSSolver{}
+	if err := solver.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	defer solver.CleanUp(context.Background(), challenge)
+
+	// a record published at the target of a delegated _acme-challenge CNAME
+	presentedChallenges.add("delegated.auth.example.com.", "delegated")
+	defer presentedChallenges.remove("delegated.auth.example.com.", "delegated")
+
+	h := ChallengeHandler{Next: test.NextHandler(dns.RcodeNameError, nil)}
+
+	tests := []struct {
+		qname         string
+		qtype         uint16
+		expectedRcode int
+		expectedTXT   string // expected TXT value. Empty if the query is passed on.
+	}{
+		{"_acme-challenge.example.com.", dns.TypeTXT, dns.RcodeSuccess, challenge.DNS01KeyAuthorization()},
+		{"_ACME-challenge.Example.com.", dns.TypeTXT, dns.RcodeSuccess, challenge.DNS01KeyAuthorization()},
+		{"delegated.auth.example.com.", dns.TypeTXT, dns.RcodeSuccess, "delegated"},
+		// everything else goes on to the next plugin
+		{"_acme-challenge.example.com.", dns.TypeA, dns.RcodeNameError, ""},
+		{"_acme-challenge.example.org.", dns.TypeTXT, dns.RcodeNameError, ""},
+		{"example.com.", dns.TypeTXT, dns.RcodeNameError, ""},
+	}
+
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+		rcode, err := h.ServeDNS(context.Background(), rec, req)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %s", i, err)
+			continue
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: Expected rcode %d, got %d", i, tc.expectedRcode, rcode)
+		}
+		if tc.expectedTXT == "" {
+			continue
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: Expected one answer, got %v", i, rec.Msg)
+			continue
+		}
+		txt, ok := rec.Msg.Answer[0].(*dns.TXT)
+		if !ok || len(txt.Txt) != 1 || txt.Txt[0] != tc.expectedTXT {
+			t.Errorf("Test %d: Expected TXT %q, got %s", i, tc.expectedTXT, rec.Msg.Answer[0])
+		}
+	}
+}
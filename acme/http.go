@@ -0,0 +1,149 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// HTTPSolver solves http-01 challenges by serving the key authorizations at
+// /.well-known/acme-challenge/<token> on Addr. The CA requests them on port 80,
+// so Addr has to be reachable on that port, possibly through a load balancer.
+// Addr is only listened on while challenges are presented.
+type HTTPSolver struct {
+	// Addr is the address the challenges are served on.
+	Addr string
+}
+
+// httpChallengeBasePath is the path the key authorizations are served under.
+const httpChallengeBasePath = "/.well-known/acme-challenge/"
+
+// presentedHTTPChallenges holds the key authorizations of all http-01
+// challenges that are presented, by token. Like presentedChallenges, it
+// is shared, so every HTTPChallengeHandler answers all challenges.
+var presentedHTTPChallenges httpChallengeStore
+
+// httpChallengeStore holds the key authorizations of
+// the http-01 challenges that are currently presented.
+type httpChallengeStore struct {
+	mu       sync.RWMutex
+	keyAuths map[string]string
+}
+
+// add serves keyAuth for token.
+func (s *httpChallengeStore) add(token, keyAuth string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyAuths == nil {
+		s.keyAuths = make(map[string]string)
+	}
+	s.keyAuths[token] = keyAuth
+}
+
+// remove stops serving the key authorization for token.
+func (s *httpChallengeStore) remove(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keyAuths, token)
+}
+
+// lookup returns the key authorization for token.
+func (s *httpChallengeStore) lookup(token string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyAuth, ok := s.keyAuths[token]
+	return keyAuth, ok
+}
+
+// httpChallengeServers are the servers answering http-01 challenges, by
+// address. A server is shared by all solvers with the same address, and
+// runs as long as one of them presents a challenge.
+var (
+	httpChallengeServersMu sync.Mutex
+	httpChallengeServers   = make(map[string]*httpChallengeServer)
+)
+
+// httpChallengeServer is a server answering http-01 challenges.
+type httpChallengeServer struct {
+	server   *http.Server
+	listener net.Listener
+	refs     int
+}
+
+// Present serves the challenge on Addr.
+func (s *HTTPSolver) Present(_ context.Context, challenge acme.Challenge) error {
+	if err := startHTTPChallengeServer(s.Addr); err != nil {
+		return err
+	}
+	presentedHTTPChallenges.add(challenge.Token, challenge.KeyAuthorization)
+	return nil
+}
+
+// CleanUp stops serving the challenge, and stops listening
+// on Addr if no other challenge is served on it.
+func (s *HTTPSolver) CleanUp(_ context.Context, challenge acme.Challenge) error {
+	presentedHTTPChallenges.remove(challenge.Token)
+	return stopHTTPChallengeServer(s.Addr)
+}
+
+// startHTTPChallengeServer starts the server answering
+// challenges on addr, unless it is running already.
+func startHTTPChallengeServer(addr string) error {
+	httpChallengeServersMu.Lock()
+	defer httpChallengeServersMu.Unlock()
+	if s, ok := httpChallengeServers[addr]; ok {
+		s.refs++
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for http-01 challenges: %v", err)
+	}
+	server := &http.Server{
+		Handler:           HTTPChallengeHandler(http.NotFoundHandler()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(ln)
+	httpChallengeServers[addr] = &httpChallengeServer{server: server, listener: ln, refs: 1}
+	return nil
+}
+
+// stopHTTPChallengeServer stops the server answering challenges
+// on addr, once it was stopped as often as it was started.
+func stopHTTPChallengeServer(addr string) error {
+	httpChallengeServersMu.Lock()
+	defer httpChallengeServersMu.Unlock()
+	s, ok := httpChallengeServers[addr]
+	if !ok {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(httpChallengeServers, addr)
+	return s.server.Close()
+}
+
+// HTTPChallengeHandler answers the http-01 challenges presented by HTTPSolver
+// and passes all other requests on to next. It can be used to answer the
+// challenges from an HTTP server that listens on port 80 already.
+func HTTPChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, httpChallengeBasePath) {
+			if keyAuth, ok := presentedHTTPChallenges.lookup(strings.TrimPrefix(r.URL.Path, httpChallengeBasePath)); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
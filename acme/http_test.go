@@ -0,0 +1,110 @@
+package acme
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// httpChallengeServerURL returns the URL of the running server answering
+// challenges on addr, or the empty string if there is none.
+func httpChallengeServerURL(addr string) string {
+	httpChallengeServersMu.Lock()
+	defer httpChallengeServersMu.Unlock()
+	s, ok := httpChallengeServers[addr]
+	if !ok {
+		return ""
+	}
+	return "http://" + s.listener.Addr().String()
+}
+
+func getKeyAuthorization(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", url, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTPSolver(t *testing.T) {
+	ctx := context.Background()
+	addr := "127.0.0.1:0"
+	first := acme.Challenge{Type: acme.ChallengeTypeHTTP01, Token: "first", KeyAuthorization: "first.thumbprint"}
+	second := acme.Challenge{Type: acme.ChallengeTypeHTTP01, Token: "second", KeyAuthorization: "second.thumbprint"}
+
+	// solvers with the same address share the listener
+	solvers := []*HTTPSolver{{Addr: addr}, {Addr: addr}}
+	if err := solvers[0].Present(ctx, first); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	if err := solvers[1].Present(ctx, second); err != nil {
+		t.Fatalf("Failed to present second challenge: %s", err)
+	}
+	url := httpChallengeServerURL(addr)
+	if url == "" {
+		t.Fatalf("Expected challenges to be served")
+	}
+
+	for _, challenge := range []acme.Challenge{first, second} {
+		status, body := getKeyAuthorization(t, url+challenge.HTTP01ResourcePath())
+		if status != http.StatusOK || body != challenge.KeyAuthorization {
+			t.Errorf("Expected key authorization %q, got %d %q", challenge.KeyAuthorization, status, body)
+		}
+	}
+	if status, _ := getKeyAuthorization(t, url+"/.well-known/acme-challenge/unknown"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown token, got %d", status)
+	}
+
+	solvers[0].CleanUp(ctx, first)
+	if status, _ := getKeyAuthorization(t, url+first.HTTP01ResourcePath()); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for cleaned up challenge, got %d", status)
+	}
+	if status, body := getKeyAuthorization(t, url+second.HTTP01ResourcePath()); status != http.StatusOK || body != second.KeyAuthorization {
+		t.Errorf("Expected second challenge to be served still, got %d %q", status, body)
+	}
+
+	solvers[1].CleanUp(ctx, second)
+	if url := httpChallengeServerURL(addr); url != "" {
+		t.Errorf("Expected listener to be closed once all challenges are cleaned up")
+	}
+}
+
+func TestHTTPChallengeHandler(t *testing.T) {
+	challenge := acme.Challenge{Type: acme.ChallengeTypeHTTP01, Token: "token", KeyAuthorization: "token.thumbprint"}
+	presentedHTTPChallenges.add(challenge.Token, challenge.KeyAuthorization)
+	defer presentedHTTPChallenges.remove(challenge.Token)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := HTTPChallengeHandler(next)
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{http.MethodGet, challenge.HTTP01ResourcePath(), http.StatusOK, challenge.KeyAuthorization},
+		{http.MethodPost, challenge.HTTP01ResourcePath(), http.StatusTeapot, ""},
+		{http.MethodGet, "/.well-known/acme-challenge/other", http.StatusTeapot, ""},
+		{http.MethodGet, "/dns-query", http.StatusTeapot, ""},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.expectedStatus || w.Body.String() != test.expectedBody {
+			t.Errorf("Test %d: Expected %d %q, got %d %q", i, test.expectedStatus, test.expectedBody, w.Code, w.Body.String())
+		}
+	}
+}
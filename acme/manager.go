@@ -2,31 +2,170 @@ package acme
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
 )
 
 type AcmeManager struct {
-	CA          string
-	Email       string
-	DNS01Solver acmez.Solver
-	Config      *Config
+	CA              string
+	Email           string
+	DNS01Solver     acmez.Solver
+	HTTP01Solver    acmez.Solver
+	TLSALPN01Solver acmez.Solver
+	Config          *Config
+
+	// cache holds the certificate that is served.
+	cache CertCache
+
+	// loaded is the certificate last loaded from storage, it
+	// is reused as long as its bundle in storage is unchanged.
+	loadedMu sync.Mutex
+	loaded   *loadedCertificate
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+
+	// failures is how many times in a row obtaining the certificate
+	// failed, it is not obtained again before retryAfter. Both are
+	// only used by the background renewal.
+	failures   int
+	retryAfter time.Time
+
+	transportOnce sync.Once
+	transport     *http.Transport
+
+	// cancel stops the background renewal started by Start,
+	// which closes done once it returned.
+	loopMu sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func NewACMEManager(cfg *Config) (*AcmeManager, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("Missing Config")
 	}
+	if cfg.Storage == nil {
+		cfg.Storage = DefaultStorage()
+	}
+
+	var solver acmez.Solver = &DNSSolver{
+		Addr:               cfg.LocalDNSAddr,
+		PropagationTimeout: cfg.PropagationTimeout,
+		CheckNameservers:   cfg.CheckNameservers,
+	}
+	if cfg.DNSProvider != nil {
+		solver = &DNSProviderSolver{
+			Provider:           cfg.DNSProvider,
+			Resolver:           cfg.LocalDNSAddr,
+			PropagationTimeout: cfg.PropagationTimeout,
+		}
+	}
 
 	return &AcmeManager{
-		CA:          "https://pebble:14000/dir", //pebble
-		Email:       "Test@test.test",
-		DNS01Solver: &DNSSolver{},
-		Config:      cfg,
+		CA:              cfg.CA,
+		Email:           cfg.Email,
+		DNS01Solver:     solver,
+		HTTP01Solver:    &HTTPSolver{Addr: cfg.HTTPChallengeAddr},
+		TLSALPN01Solver: TLSALPNSolver{},
+		Config:          cfg,
+		now:             time.Now,
 	}, nil
 }
 
-func (AcmeManager) renewManagedCertificates(ctx context.Context) error {
-	return nil
+// SetLocalDNSAddr sets the address CoreDNS serves plain DNS on, which the
+// solvers look up the records of challenges at. It must be called before
+// the manager is started.
+func (m *AcmeManager) SetLocalDNSAddr(addr string) {
+	m.Config.LocalDNSAddr = addr
+	switch solver := m.DNS01Solver.(type) {
+	case *DNSSolver:
+		solver.Addr = addr
+	case *DNSProviderSolver:
+		solver.Resolver = addr
+	}
+}
+
+// unlock releases the lock for key. The context the lock was obtained
+// with is not used, as it may have been cancelled by Stop by now.
+func (m *AcmeManager) unlock(key string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	if err := m.Config.Storage.Unlock(ctx, key); err != nil {
+		log.Warningf("Failed to release lock %s: %v", key, err)
+	}
+}
+
+// solvers returns the solvers of the manager by challenge type.
+func (m *AcmeManager) solvers() map[string]acmez.Solver {
+	return map[string]acmez.Solver{
+		acme.ChallengeTypeDNS01:     m.DNS01Solver,
+		acme.ChallengeTypeHTTP01:    m.HTTP01Solver,
+		acme.ChallengeTypeTLSALPN01: m.TLSALPN01Solver,
+	}
+}
+
+// GetCertificate returns the certificate obtained by the manager. A renewed
+// certificate is returned from the next handshake on. It can be used as
+// tls.Config.GetCertificate.
+func (m *AcmeManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cache.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate obtained yet for %v", m.Config.Domains)
+	}
+	return cert, nil
+}
+
+// LoadCertificate serves the certificate in storage, if there is a valid one,
+// until it is renewed. It returns false if there is no valid certificate in
+// storage, a new one is obtained once the manager is started then.
+func (m *AcmeManager) LoadCertificate(ctx context.Context) (bool, error) {
+	cert, err := m.loadValidCertificate(ctx)
+	if err != nil || cert == nil {
+		return false, err
+	}
+	m.setCertificate(cert)
+	return true, nil
+}
+
+// Start obtains and renews the certificate in the background, until Stop is
+// called. It does nothing if the manager is already started.
+func (m *AcmeManager) Start() {
+	m.loopMu.Lock()
+	defer m.loopMu.Unlock()
+	if m.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.cancel, m.done = cancel, done
+	go func() {
+		defer close(done)
+		m.ObtainAndRenew(ctx)
+	}()
+}
+
+// Stop stops the background renewal started by Start and waits for it to
+// return, so that it does not overlap with the one of a reloaded
+// configuration. It does nothing if the manager is not started.
+func (m *AcmeManager) Stop() {
+	m.loopMu.Lock()
+	defer m.loopMu.Unlock()
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	<-m.done
+	m.cancel, m.done = nil, nil
+	m.httpTransport().CloseIdleConnections()
+}
+
+func (m *AcmeManager) setCertificate(cert *tls.Certificate) {
+	m.cache.Store(cert)
 }
@@ -0,0 +1,75 @@
+package acme
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestManagerReloadDoesNotLeakGoroutines(t *testing.T) {
+	srv := newTestACMEServer(t)
+	storage := NewMemoryStorage()
+	before := runtime.NumGoroutine()
+
+	// every reload replaces the manager by one for the same
+	// certificate, the previous one is stopped before it is started
+	var previous *AcmeManager
+	for i := 0; i < 5; i++ {
+		m := newTestRenewalManager(t, srv)
+		m.Config.Storage = storage
+		m.Config.RenewCheckInterval = 10 * time.Millisecond
+
+		if previous != nil {
+			previous.Stop()
+		}
+		m.Start()
+		m.Start()
+		waitFor(t, func() bool {
+			_, err := m.GetCertificate(nil)
+			return err == nil
+		})
+		previous = m
+	}
+	previous.Stop()
+	previous.Stop()
+
+	if n := srv.numOrders(); n != 1 {
+		t.Errorf("Expected the certificate to be obtained once, got %d orders", n)
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// waitFor fails the test if cond does not become true within a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("Condition not met in time, goroutines:\n%s", buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetLocalDNSAddr(t *testing.T) {
+	cfg := NewConfig([]string{"example.com"}, NewMemoryStorage())
+	m, err := NewACMEManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %s", err)
+	}
+	m.SetLocalDNSAddr("192.0.2.1:53")
+	if addr := m.DNS01Solver.(*DNSSolver).Addr; addr != "192.0.2.1:53" {
+		t.Errorf("Expected the DNS solver to query 192.0.2.1:53, got %s", addr)
+	}
+
+	cfg.DNSProvider = &testProvider{}
+	m, err = NewACMEManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %s", err)
+	}
+	m.SetLocalDNSAddr("192.0.2.1:53")
+	if addr := m.DNS01Solver.(*DNSProviderSolver).Resolver; addr != "192.0.2.1:53" {
+		t.Errorf("Expected the DNS provider solver to query 192.0.2.1:53, got %s", addr)
+	}
+}
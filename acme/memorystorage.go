@@ -0,0 +1,173 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage that keeps everything in memory, for tests and
+// deployments that do not need to keep certificates across restarts. Its locks
+// only synchronize the users of the same MemoryStorage, so they never expire.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	locks  map[string]chan struct{}
+}
+
+// memoryValue is a value in a MemoryStorage.
+type memoryValue struct {
+	value    []byte
+	modified time.Time
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		values: make(map[string]memoryValue),
+		locks:  make(map[string]chan struct{}),
+	}
+}
+
+// memoryKey normalizes key, so that "a/b/" and "/a/b" are the same key.
+func memoryKey(key string) string {
+	return strings.Trim(path.Clean("/"+key), "/")
+}
+
+// Store puts value at key.
+func (s *MemoryStorage) Store(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[memoryKey(key)] = memoryValue{
+		value:    append([]byte(nil), value...),
+		modified: time.Now(),
+	}
+	return nil
+}
+
+// Load retrieves the value at key.
+func (s *MemoryStorage) Load(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[memoryKey(key)]
+	if !ok {
+		return nil, &fs.PathError{Op: "load", Path: key, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), v.value...), nil
+}
+
+// Delete deletes key.
+func (s *MemoryStorage) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, memoryKey(key))
+	return nil
+}
+
+// Exists returns true if key exists.
+func (s *MemoryStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys that match prefix, including the keys that only
+// contain other keys. Like FileStorage, an error satisfying
+// errors.Is(err, fs.ErrNotExist) is returned if there are none.
+func (s *MemoryStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	prefix = memoryKey(prefix)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var keys []string
+	for key := range s.values {
+		if prefix != "" && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(key[len(prefix):], "/"), "/")
+		if !recursive {
+			parts = parts[:1]
+		}
+		for i := range parts {
+			key := path.Join(prefix, path.Join(parts[:i+1]...))
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, &fs.PathError{Op: "list", Path: prefix, Err: fs.ErrNotExist}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (s *MemoryStorage) Stat(_ context.Context, key string) (KeyInfo, error) {
+	key = memoryKey(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[key]; ok {
+		return KeyInfo{
+			Key:        key,
+			Modified:   v.modified,
+			Size:       int64(len(v.value)),
+			IsTerminal: true,
+		}, nil
+	}
+
+	// key may be the prefix of other keys
+	for k := range s.values {
+		if key == "" || strings.HasPrefix(k, key+"/") {
+			return KeyInfo{Key: key, IsTerminal: false}, nil
+		}
+	}
+	return KeyInfo{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+}
+
+// Lock obtains the lock for key, waiting until it is
+// released by its holder or ctx is done.
+func (s *MemoryStorage) Lock(ctx context.Context, key string) error {
+	for {
+		s.mu.Lock()
+		released, held := s.locks[key]
+		if !held {
+			s.locks[key] = make(chan struct{})
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases the lock for key.
+func (s *MemoryStorage) Unlock(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	released, held := s.locks[key]
+	if !held {
+		return fmt.Errorf("unlocking %s: not locked", key)
+	}
+	delete(s.locks, key)
+	close(released)
+	return nil
+}
+
+func (s *MemoryStorage) String() string {
+	return "memory"
+}
+
+// Interface guard
+var _ Storage = (*MemoryStorage)(nil)
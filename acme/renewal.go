@@ -2,25 +2,352 @@ package acme
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
-// an indefinitely looping function that, on a regular schedule, checks certificates for expiration
-// and initiates the renewal of certs that are expiring soon
-func (m *AcmeManager) RenewalLoop() {
-	fmt.Println("Starting to manage certificates in the background")
-	renewalTicker := time.NewTicker(m.Config.RenewCheckInterval)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// certificatePrefix returns the storage prefix of the certificate for
+// domains obtained from the CA. It is named by the sorted domains, the
+// first of them and a hash of all, so that certificates for different
+// sets of domains do not share it and reordering the domains keeps it.
+func certificatePrefix(ca string, domains []string) string {
+	sorted := append([]string(nil), domains...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	name := strings.Replace(sorted[0], "*", "wildcard_", 1) + "-" + hex.EncodeToString(sum[:4])
+	return path.Join("certificates", issuerKey(ca), safeKey(name))
+}
+
+// certificateKey returns the storage key of the PEM encoded certificate chain.
+func certificateKey(ca string, domains []string) string {
+	prefix := certificatePrefix(ca, domains)
+	return path.Join(prefix, path.Base(prefix)+".crt")
+}
+
+// privateKeyKey returns the storage key of the certificate's PEM encoded private key.
+func privateKeyKey(ca string, domains []string) string {
+	prefix := certificatePrefix(ca, domains)
+	return path.Join(prefix, path.Base(prefix)+".key")
+}
+
+// certificateBundleKey returns the storage key of the PEM encoded certificate
+// chain and private key in one value, so that they are replaced together.
+func certificateBundleKey(ca string, domains []string) string {
+	prefix := certificatePrefix(ca, domains)
+	return path.Join(prefix, path.Base(prefix)+".pem")
+}
+
+// certificateMetaKey returns the storage key of the certificate's metadata.
+func certificateMetaKey(ca string, domains []string) string {
+	prefix := certificatePrefix(ca, domains)
+	return path.Join(prefix, path.Base(prefix)+".json")
+}
+
+// certificateMeta is stored along with a certificate.
+type certificateMeta struct {
+	Domains  []string  `json:"domains"`
+	CA       string    `json:"ca"`
+	Obtained time.Time `json:"obtained"`
+}
+
+// RenewalLoop checks the managed certificate on a regular schedule and renews
+// it when it is expiring soon. A failed attempt to obtain it is retried once
+// its backoff is over, which may be before the next check. It returns once
+// ctx is done.
+func (m *AcmeManager) RenewalLoop(ctx context.Context) {
+	log.Infof("Managing certificate for %v in the background", m.Config.Domains)
+	renewalTimer := time.NewTimer(m.nextRenewalCheck())
+	defer renewalTimer.Stop()
 	for {
 		select {
-		case <-renewalTicker.C:
+		case <-ctx.Done():
+			log.Infof("Stopped managing certificate for %v", m.Config.Domains)
+			return
+		case <-renewalTimer.C:
 			err := m.renewManagedCertificates(ctx)
-			if err != nil {
-				fmt.Printf("Error during certificate renewal: %v", err)
+			if err != nil && ctx.Err() == nil {
+				log.Errorf("Error during certificate renewal: %v", err)
 			}
+			renewalTimer.Reset(m.nextRenewalCheck())
+		}
+	}
+}
+
+const (
+	// minRetryBackoff is how long to wait before obtaining a certificate again
+	// after it failed. The wait doubles with every failure in a row, up to
+	// maxRetryBackoff, so that there are at most 5 failed attempts in any hour,
+	// which is Let's Encrypt's limit of failed validations per hostname.
+	minRetryBackoff = 2 * time.Minute
+	maxRetryBackoff = 6 * time.Hour
+)
+
+// retryBackoff returns how long to wait before obtaining
+// a certificate again after failures failures in a row.
+func retryBackoff(failures int) time.Duration {
+	backoff := minRetryBackoff
+	for i := 1; i < failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// nextRenewalCheck returns how long to wait before the managed certificate is
+// checked again, which is Config.RenewCheckInterval, unless a failed attempt
+// to obtain it is retried before.
+func (m *AcmeManager) nextRenewalCheck() time.Duration {
+	wait := m.Config.RenewCheckInterval
+	if !m.retryAfter.IsZero() {
+		if retry := m.retryAfter.Sub(m.now()); retry < wait {
+			wait = retry
 		}
 	}
-	fmt.Println("RenewalLoop has ended")
+	return wait
+}
+
+// renewManagedCertificates loads the managed certificate from storage and, if it
+// is missing, invalid or inside its renewal window, obtains a new one and stores it. The
+// certificate that is served is updated either way.
+func (m *AcmeManager) renewManagedCertificates(ctx context.Context) error {
+	cert, err := m.loadValidCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	if cert != nil && !m.needsRenewal(cert.Leaf) {
+		m.setCertificate(cert)
+		return nil
+	}
+
+	// the certificate is not obtained again before the backoff after
+	// the last failure is over, the stored one is served until then
+	if m.now().Before(m.retryAfter) {
+		if cert != nil {
+			m.setCertificate(cert)
+		}
+		return nil
+	}
+
+	// another instance sharing the storage may be renewing
+	// the same certificate, so check again once locked
+	lockKey := path.Join(certificatePrefix(m.CA, m.Config.Domains), "issue")
+	if err := m.Config.Storage.Lock(ctx, lockKey); err != nil {
+		return fmt.Errorf("locking certificate: %v", err)
+	}
+	defer m.unlock(lockKey)
+
+	cert, err = m.loadValidCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	if cert != nil && !m.needsRenewal(cert.Leaf) {
+		m.setCertificate(cert)
+		return nil
+	}
+
+	if cert != nil {
+		log.Infof("Renewing certificate for %v, it expires %s", m.Config.Domains, cert.Leaf.NotAfter)
+	} else {
+		log.Infof("Obtaining certificate for %v", m.Config.Domains)
+	}
+	certPEM, keyPEM, err := m.obtainCertificate(ctx, m.Config.Domains)
+	if err != nil {
+		if ctx.Err() == nil {
+			m.failures++
+			backoff := retryBackoff(m.failures)
+			m.retryAfter = m.now().Add(backoff)
+			log.Infof("Trying again to obtain the certificate for %v in %s", m.Config.Domains, backoff)
+		}
+		return err
+	}
+	m.failures, m.retryAfter = 0, time.Time{}
+	cert, err = parseCertificate(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("loading obtained certificate: %v", err)
+	}
+	if err := m.storeCertificate(ctx, certPEM, keyPEM); err != nil {
+		return err
+	}
+	m.setCertificate(cert)
+	return nil
+}
+
+// needsRenewal returns true if cert is inside its renewal window, which is the
+// last Config.RenewalWindowRatio of its lifetime.
+func (m *AcmeManager) needsRenewal(cert *x509.Certificate) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	window := time.Duration(float64(lifetime) * m.Config.RenewalWindowRatio)
+	return !m.now().Before(cert.NotAfter.Add(-window))
+}
+
+// loadedCertificate is a certificate loaded from storage,
+// along with the information about its key at that time.
+type loadedCertificate struct {
+	cert *tls.Certificate
+	info KeyInfo
+}
+
+// loadCertificate loads the managed certificate from its bundle in storage. The
+// certificate loaded before is returned as long as the bundle is unchanged.
+func (m *AcmeManager) loadCertificate(ctx context.Context) (*tls.Certificate, error) {
+	key := certificateBundleKey(m.CA, m.Config.Domains)
+	info, err := m.Config.Storage.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.loadedMu.Lock()
+	defer m.loadedMu.Unlock()
+	if l := m.loaded; l != nil && sameKeyInfo(l.info, info) {
+		return l.cert, nil
+	}
+
+	bundle, err := m.Config.Storage.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// the bundle holds both the chain and the private key
+	cert, err := parseCertificate(bundle, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCertificate, err)
+	}
+	m.loaded = &loadedCertificate{cert: cert, info: info}
+	return cert, nil
+}
+
+// errInvalidCertificate is wrapped by the errors about a stored
+// certificate that must not be served, and has to be replaced.
+var errInvalidCertificate = errors.New("invalid certificate")
+
+// loadValidCertificate loads the managed certificate from storage and validates
+// it. It returns nil if there is no certificate in storage, or if the stored one
+// is invalid and has to be replaced.
+func (m *AcmeManager) loadValidCertificate(ctx context.Context) (*tls.Certificate, error) {
+	cert, err := m.loadCertificate(ctx)
+	if err == nil {
+		err = m.validateCertificate(ctx, cert)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case errors.Is(err, errInvalidCertificate):
+		log.Warningf("Not using the stored certificate for %v: %v", m.Config.Domains, err)
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return cert, nil
+}
+
+// validateCertificate checks that cert can be served for the configured domains:
+// it has to be valid now, cover every domain, be signed by the next certificate in
+// its chain and have been obtained from the manager's CA, as recorded in its
+// metadata when it was stored. That the private key
+// matches is checked when the certificate is parsed. The renewal window is not
+// checked, a certificate inside it is served until it is renewed.
+func (m *AcmeManager) validateCertificate(ctx context.Context, cert *tls.Certificate) error {
+	now := m.now()
+	leaf := cert.Leaf
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("%w: not valid before %s", errInvalidCertificate, leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("%w: expired %s", errInvalidCertificate, leaf.NotAfter)
+	}
+	for _, domain := range m.Config.Domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return fmt.Errorf("%w: not valid for %s", errInvalidCertificate, domain)
+		}
+	}
+
+	child := leaf
+	for i, der := range cert.Certificate[1:] {
+		parent, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: parsing chain: %v", errInvalidCertificate, err)
+		}
+		if err := child.CheckSignatureFrom(parent); err != nil {
+			return fmt.Errorf("%w: certificate %d of the chain is not issued by the next one: %v", errInvalidCertificate, i, err)
+		}
+		child = parent
+	}
+
+	// the metadata records the CA the certificate was obtained from, a
+	// certificate without it may have been issued by any CA
+	metaJSON, err := m.Config.Storage.Load(ctx, certificateMetaKey(m.CA, m.Config.Domains))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no metadata, the issuer is unknown", errInvalidCertificate)
+	}
+	if err != nil {
+		return err
+	}
+	var meta certificateMeta
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return fmt.Errorf("%w: decoding metadata: %v", errInvalidCertificate, err)
+	}
+	if meta.CA != m.CA {
+		return fmt.Errorf("%w: obtained from %s, not %s", errInvalidCertificate, meta.CA, m.CA)
+	}
+	return nil
+}
+
+// sameKeyInfo returns true if a and b describe the same unchanged key.
+func sameKeyInfo(a, b KeyInfo) bool {
+	return a.Key == b.Key && a.Modified.Equal(b.Modified) && a.Size == b.Size
+}
+
+// storeCertificate stores the managed certificate and its metadata. The chain
+// and private key are stored as one bundle in a single key, which is replaced
+// atomically, so that a chain is never loaded along with another private key.
+// They are also stored in separate keys for other tools, e.g. as the tls.crt
+// and tls.key of a Kubernetes Secret, which are never loaded.
+func (m *AcmeManager) storeCertificate(ctx context.Context, certPEM, keyPEM []byte) error {
+	meta, err := json.Marshal(certificateMeta{
+		Domains:  m.Config.Domains,
+		CA:       m.CA,
+		Obtained: m.now(),
+	})
+	if err != nil {
+		return fmt.Errorf("encoding certificate metadata: %v", err)
+	}
+	bundle := append(append([]byte(nil), certPEM...), keyPEM...)
+	if err := m.Config.Storage.Store(ctx, certificateMetaKey(m.CA, m.Config.Domains), meta); err != nil {
+		return fmt.Errorf("storing certificate metadata: %v", err)
+	}
+	if err := m.Config.Storage.Store(ctx, certificateBundleKey(m.CA, m.Config.Domains), bundle); err != nil {
+		return fmt.Errorf("storing certificate bundle: %v", err)
+	}
+	if err := m.Config.Storage.Store(ctx, privateKeyKey(m.CA, m.Config.Domains), keyPEM); err != nil {
+		return fmt.Errorf("storing private key: %v", err)
+	}
+	if err := m.Config.Storage.Store(ctx, certificateKey(m.CA, m.Config.Domains), certPEM); err != nil {
+		return fmt.Errorf("storing certificate: %v", err)
+	}
+	return nil
+}
+
+// parseCertificate returns the certificate of the PEM encoded chain
+// and private key, with its leaf parsed.
+func parseCertificate(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
 }
@@ -0,0 +1,448 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// testSolver solves challenges of the testACMEServer, which
+// validates them without looking at any records.
+type testSolver struct{}
+
+func (testSolver) Present(context.Context, acme.Challenge) error { return nil }
+func (testSolver) CleanUp(context.Context, acme.Challenge) error { return nil }
+
+func newTestRenewalManager(t *testing.T, srv *testACMEServer) *AcmeManager {
+	m := newTestManager(t, srv)
+	m.DNS01Solver = testSolver{}
+	return m
+}
+
+func TestRenewManagedCertificatesObtain(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestRenewalManager(t, srv)
+	m.Config.Domains = []string{"example.com", "*.example.com"}
+
+	if err := m.renewManagedCertificates(context.Background()); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+	if n := srv.numOrders(); n != 1 {
+		t.Errorf("Expected 1 order, got %d", n)
+	}
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected certificate to be served: %s", err)
+	}
+	if err := cert.Leaf.VerifyHostname("www.example.com"); err != nil {
+		t.Errorf("Expected certificate for the wildcard: %s", err)
+	}
+	for _, key := range []string{
+		certificateBundleKey(m.CA, m.Config.Domains),
+		certificateKey(m.CA, m.Config.Domains),
+		privateKeyKey(m.CA, m.Config.Domains),
+		certificateMetaKey(m.CA, m.Config.Domains),
+	} {
+		if !m.Config.Storage.Exists(context.Background(), key) {
+			t.Errorf("Expected %s to be stored", key)
+		}
+	}
+}
+
+func TestRenewManagedCertificates(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+
+	start := time.Now()
+	m.now = func() time.Time { return start }
+	srv.now = m.now
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+	stored, err := m.Config.Storage.Load(ctx, certificateKey(m.CA, m.Config.Domains))
+	if err != nil {
+		t.Fatalf("Failed to load stored certificate: %s", err)
+	}
+
+	tests := []struct {
+		now            time.Time
+		expectedOrders int
+	}{
+		// outside of the renewal window, the last third of 90 days
+		{start.Add(time.Hour), 1},
+		{start.Add(59 * 24 * time.Hour), 1},
+		// inside of it
+		{start.Add(61 * 24 * time.Hour), 2},
+		// the renewed certificate is not renewed right away
+		{start.Add(61*24*time.Hour + time.Hour), 2},
+	}
+
+	for i, test := range tests {
+		m.now = func() time.Time { return test.now }
+		srv.now = m.now
+		if err := m.renewManagedCertificates(ctx); err != nil {
+			t.Fatalf("Test %d: Failed to renew certificates: %s", i, err)
+		}
+		if n := srv.numOrders(); n != test.expectedOrders {
+			t.Errorf("Test %d: Expected %d orders, got %d", i, test.expectedOrders, n)
+		}
+	}
+
+	renewed, err := m.Config.Storage.Load(ctx, certificateKey(m.CA, m.Config.Domains))
+	if err != nil {
+		t.Fatalf("Failed to load stored certificate: %s", err)
+	}
+	if bytes.Equal(stored, renewed) {
+		t.Errorf("Expected stored certificate to be replaced")
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected certificate to be served: %s", err)
+	}
+	if expires := start.Add(61 * 24 * time.Hour).Add(srv.certLifetime); !cert.Leaf.NotAfter.Equal(expires.Truncate(time.Second)) {
+		t.Errorf("Expected renewed certificate expiring %s to be served, got %s", expires, cert.Leaf.NotAfter)
+	}
+}
+
+func TestCertificateKeys(t *testing.T) {
+	ca := LetsEncryptProductionCA
+	tests := []struct {
+		domains         []string
+		expectedCertKey string
+		expectedKeyKey  string
+		expectedMetaKey string
+	}{
+		{
+			[]string{"example.com", "dns.example.com"},
+			"certificates/acme-v02.api.letsencrypt.org-directory/dns.example.com-a35d2249/dns.example.com-a35d2249.crt",
+			"certificates/acme-v02.api.letsencrypt.org-directory/dns.example.com-a35d2249/dns.example.com-a35d2249.key",
+			"certificates/acme-v02.api.letsencrypt.org-directory/dns.example.com-a35d2249/dns.example.com-a35d2249.json",
+		},
+		{
+			[]string{"*.example.com"},
+			"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.com-47287a8f/wildcard_.example.com-47287a8f.crt",
+			"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.com-47287a8f/wildcard_.example.com-47287a8f.key",
+			"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.com-47287a8f/wildcard_.example.com-47287a8f.json",
+		},
+	}
+
+	for i, test := range tests {
+		if key := certificateKey(ca, test.domains); key != test.expectedCertKey {
+			t.Errorf("Test %d: Expected certificate key %s, got %s", i, test.expectedCertKey, key)
+		}
+		if key := privateKeyKey(ca, test.domains); key != test.expectedKeyKey {
+			t.Errorf("Test %d: Expected private key key %s, got %s", i, test.expectedKeyKey, key)
+		}
+		if key := certificateMetaKey(ca, test.domains); key != test.expectedMetaKey {
+			t.Errorf("Test %d: Expected metadata key %s, got %s", i, test.expectedMetaKey, key)
+		}
+	}
+}
+
+func TestCertificatePrefixDomains(t *testing.T) {
+	ca := LetsEncryptProductionCA
+	tests := []struct {
+		a, b         []string
+		expectedSame bool
+	}{
+		{[]string{"example.com", "dns.example.com"}, []string{"example.com", "dns.example.com"}, true},
+		{[]string{"example.com", "dns.example.com"}, []string{"example.com", "doh.example.com"}, false},
+		{[]string{"example.com", "dns.example.com"}, []string{"example.com"}, false},
+		// the order of the domains does not matter
+		{[]string{"example.com", "dns.example.com"}, []string{"dns.example.com", "example.com"}, true},
+	}
+
+	for i, test := range tests {
+		a, b := certificatePrefix(ca, test.a), certificatePrefix(ca, test.b)
+		if (a == b) != test.expectedSame {
+			t.Errorf("Test %d: Expected prefixes %s and %s to be the same %t", i, a, b, test.expectedSame)
+		}
+	}
+}
+
+func TestLoadCertificateUnchanged(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+
+	first, err := m.loadCertificate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %s", err)
+	}
+	second, err := m.loadCertificate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to load certificate again: %s", err)
+	}
+	if first != second {
+		t.Errorf("Expected unchanged certificate not to be parsed again")
+	}
+
+	certPEM, keyPEM := newTestKeyPair(t, "example.com")
+	if err := m.storeCertificate(ctx, certPEM, keyPEM); err != nil {
+		t.Fatalf("Failed to store certificate: %s", err)
+	}
+	changed, err := m.loadCertificate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to load changed certificate: %s", err)
+	}
+	if changed == second || changed.Leaf.Subject.CommonName != "example.com" {
+		t.Errorf("Expected changed certificate to be loaded")
+	}
+}
+
+func TestLoadCertificateBundle(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+	obtained, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected certificate to be served: %s", err)
+	}
+
+	// a write of the separate private key that is not followed by the
+	// certificate, e.g. by a crashed replica, does not affect the bundle
+	_, keyPEM := newTestKeyPair(t, "example.com")
+	if err := m.Config.Storage.Store(ctx, privateKeyKey(m.CA, m.Config.Domains), keyPEM); err != nil {
+		t.Fatalf("Failed to store private key: %s", err)
+	}
+	cert, err := m.loadValidCertificate(ctx)
+	if err != nil || cert == nil {
+		t.Fatalf("Expected the bundled certificate to be loaded, got %v: %v", cert, err)
+	}
+	if !bytes.Equal(cert.Leaf.Raw, obtained.Leaf.Raw) {
+		t.Errorf("Expected the obtained certificate to be loaded")
+	}
+}
+
+func TestLoadCertificateValidates(t *testing.T) {
+	srv := newTestACMEServer(t)
+	obtained := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+	if err := obtained.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to obtain certificate: %s", err)
+	}
+	certPEM, err := obtained.Config.Storage.Load(ctx, certificateKey(obtained.CA, obtained.Config.Domains))
+	if err != nil {
+		t.Fatalf("Failed to load stored certificate: %s", err)
+	}
+	keyPEM, err := obtained.Config.Storage.Load(ctx, privateKeyKey(obtained.CA, obtained.Config.Domains))
+	if err != nil {
+		t.Fatalf("Failed to load stored private key: %s", err)
+	}
+	leaf, _ := pem.Decode(certPEM)
+	leafPEM := pem.EncodeToMemory(leaf)
+	selfSignedCertPEM, selfSignedKeyPEM := newTestKeyPair(t, "example.com")
+	otherCertPEM, otherKeyPEM := newTestKeyPair(t, "other.example.com")
+	meta := func(ca string) []byte {
+		meta, _ := json.Marshal(certificateMeta{Domains: []string{"example.com"}, CA: ca})
+		return meta
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		certPEM  []byte
+		keyPEM   []byte
+		meta     []byte // nil for no metadata
+		now      time.Time
+		expected bool
+	}{
+		{"obtained", certPEM, keyPEM, meta(obtained.CA), now, true},
+		{"without metadata", certPEM, keyPEM, nil, now, false},
+		{"self-signed without metadata", selfSignedCertPEM, selfSignedKeyPEM, nil, now, false},
+		{"expired", certPEM, keyPEM, meta(obtained.CA), now.Add(srv.certLifetime + time.Hour), false},
+		{"not yet valid", certPEM, keyPEM, meta(obtained.CA), now.Add(-time.Hour), false},
+		{"other domain", otherCertPEM, otherKeyPEM, nil, now, false},
+		{"other private key", certPEM, otherKeyPEM, meta(obtained.CA), now, false},
+		{"other CA", certPEM, keyPEM, meta("https://ca.example.net/directory"), now, false},
+		{"other issuer", append(leafPEM, otherCertPEM...), keyPEM, meta(obtained.CA), now, false},
+	}
+
+	for _, test := range tests {
+		m := newTestRenewalManager(t, srv)
+		m.now = func() time.Time { return test.now }
+		values := map[string][]byte{
+			certificateBundleKey(m.CA, m.Config.Domains): append(append([]byte(nil), test.certPEM...), test.keyPEM...),
+			certificateMetaKey(m.CA, m.Config.Domains):   test.meta,
+		}
+		for key, value := range values {
+			if value == nil {
+				continue
+			}
+			if err := m.Config.Storage.Store(ctx, key, value); err != nil {
+				t.Fatalf("%s: Failed to store %s: %s", test.name, key, err)
+			}
+		}
+
+		present, err := m.LoadCertificate(ctx)
+		if err != nil {
+			t.Errorf("%s: Failed to load certificate: %s", test.name, err)
+			continue
+		}
+		if present != test.expected {
+			t.Errorf("%s: Expected certificate to be loaded %t, got %t", test.name, test.expected, present)
+		}
+		if _, err := m.GetCertificate(nil); (err == nil) != test.expected {
+			t.Errorf("%s: Expected certificate to be served %t, got: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestRenewManagedCertificatesInvalid(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+
+	// a certificate far from its renewal window, but for another domain
+	certPEM, keyPEM := newTestKeyPair(t, "other.example.com")
+	if err := m.storeCertificate(ctx, certPEM, keyPEM); err != nil {
+		t.Fatalf("Failed to store certificate: %s", err)
+	}
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to renew certificates: %s", err)
+	}
+	if n := srv.numOrders(); n != 1 {
+		t.Errorf("Expected invalid certificate to be replaced by 1 order, got %d", n)
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected certificate to be served: %s", err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Errorf("Expected certificate for example.com to be served: %s", err)
+	}
+}
+
+// unlockRecordingStorage records the context errors seen by Unlock.
+type unlockRecordingStorage struct {
+	Storage
+	mu         sync.Mutex
+	unlockErrs []error
+}
+
+func (s *unlockRecordingStorage) Unlock(ctx context.Context, key string) error {
+	s.mu.Lock()
+	s.unlockErrs = append(s.unlockErrs, ctx.Err())
+	s.mu.Unlock()
+	return s.Storage.Unlock(ctx, key)
+}
+
+func TestRenewManagedCertificatesUnlockCancelled(t *testing.T) {
+	srv := newTestACMEServer(t)
+	m := newTestManager(t, srv)
+	storage := &unlockRecordingStorage{Storage: m.Config.Storage}
+	m.Config.Storage = storage
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Stop cancels the renewal while the order is solved
+	m.DNS01Solver = &cancellingSolver{cancel: cancel, cleanupErr: make(chan error, 1)}
+
+	if err := m.renewManagedCertificates(ctx); err == nil {
+		t.Fatal("Expected cancelled renewal to fail")
+	}
+	if len(storage.unlockErrs) == 0 {
+		t.Fatal("Expected the locks to be released")
+	}
+	for _, err := range storage.unlockErrs {
+		if err != nil {
+			t.Errorf("Expected the locks to be released with a live context, got: %v", err)
+		}
+	}
+}
+
+func TestRenewManagedCertificatesBackoff(t *testing.T) {
+	srv := newTestACMEServer(t)
+	var failing int32 = 1
+	srv.validateChallenge = func(string) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return fmt.Errorf("no TXT record found")
+		}
+		return nil
+	}
+	m := newTestRenewalManager(t, srv)
+	ctx := context.Background()
+
+	// the certificate is checked every minute for three hours, while it
+	// cannot be obtained; the failed orders must stay below the limit
+	// of 5 failed validations per hour
+	start := time.Now()
+	var failed []time.Time
+	for now := start; now.Before(start.Add(3 * time.Hour)); now = now.Add(time.Minute) {
+		m.now = func() time.Time { return now }
+		orders := srv.numOrders()
+		if err := m.renewManagedCertificates(ctx); err != nil {
+			failed = append(failed, now)
+		}
+		if n := srv.numOrders() - orders; n != 0 && n != 1 {
+			t.Fatalf("Expected at most 1 order per check, got %d", n)
+		}
+	}
+	if len(failed) != srv.numOrders() {
+		t.Errorf("Expected an error for each of the %d orders, got %d", srv.numOrders(), len(failed))
+	}
+	if len(failed) < 2 || failed[1].Sub(failed[0]) != minRetryBackoff {
+		t.Errorf("Expected the first retry after %s, got failures at %v", minRetryBackoff, failed)
+	}
+	for i := range failed {
+		if i >= 5 && failed[i].Sub(failed[i-5]) < time.Hour {
+			t.Errorf("Expected at most 5 failures per hour, got %v", failed[i-5:i+1])
+		}
+	}
+
+	// once it can be obtained, it is on the first retry
+	atomic.StoreInt32(&failing, 0)
+	now := failed[len(failed)-1]
+	m.now = func() time.Time { return now }
+	srv.now = m.now
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to renew certificates: %s", err)
+	}
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Errorf("Expected no certificate to be obtained before the backoff is over")
+	}
+	now = m.retryAfter
+	if err := m.renewManagedCertificates(ctx); err != nil {
+		t.Fatalf("Failed to renew certificates: %s", err)
+	}
+	if _, err := m.GetCertificate(nil); err != nil {
+		t.Errorf("Expected certificate to be served once the backoff is over: %s", err)
+	}
+	if !m.retryAfter.IsZero() || m.nextRenewalCheck() != m.Config.RenewCheckInterval {
+		t.Errorf("Expected the backoff to be reset, retrying at %s", m.retryAfter)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{5, 32 * time.Minute},
+		{8, 256 * time.Minute},
+		{9, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if backoff := retryBackoff(test.failures); backoff != test.expected {
+			t.Errorf("Expected backoff %s after %d failures, got %s", test.expected, test.failures, backoff)
+		}
+	}
+}
@@ -8,122 +8,351 @@ import (
 	"sync"
 	"time"
 
-	"github.com/coredns/coredns/core/dnsserver"
-	"github.com/coredns/coredns/request"
 	"github.com/mholt/acmez/acme"
 	"github.com/miekg/dns"
 )
 
+// DNSSolver solves dns-01 challenges with CoreDNS itself. The TXT records
+// are served by the ChallengeHandler in the plugin chain. If the record name
+// of a challenge is a CNAME, e.g. to delegate it to a validation zone, the
+// TXT record is served at the end of the CNAME chain instead.
 type DNSSolver struct {
-	Addr   string
-	Config *dnsserver.Config
-	DNS    *ACMEServer
-}
+	// Addr is the address of the local DNS server. CNAMEs
+	// are not followed if it is empty.
+	Addr string
 
-type ACMEServer struct {
-	m      sync.Mutex  // protects the servers
-	server *dns.Server // 0 is a net.Listener, 1 is a net.PacketConn (a *UDPConn) in our case.
-}
+	// PropagationTimeout is how long Wait waits for
+	// the TXT record to be published.
+	PropagationTimeout time.Duration
 
-var (
-	ch chan string
-)
+	// CheckNameservers makes Wait check that every authoritative
+	// nameserver of the zone serves the TXT record, not just
+	// the local server.
+	CheckNameservers bool
 
-func NewACMEServer(addr string) *ACMEServer {
-	as := &ACMEServer{}
-	return as
+	// nameserverPort is the port nameservers are queried on.
+	nameserverPort string
+
+	// nameserversOnly makes Wait check the authoritative
+	// nameservers only, Addr is just used to look them up.
+	nameserversOnly bool
+
+	// targets are the names the TXT records of the presented
+	// challenges are published at, by challengeKey.
+	targetsMu sync.Mutex
+	targets   map[string]string
 }
 
 const (
-	tcp = 0
-	udp = 1
+	// propagationInitialBackoff and propagationMaxBackoff bound
+	// the time between two checks for a published TXT record.
+	propagationInitialBackoff = 250 * time.Millisecond
+	propagationMaxBackoff     = 10 * time.Second
+
+	// maxCNAMEs is how many CNAMEs are followed
+	// from the record name of a challenge.
+	maxCNAMEs = 8
 )
 
-type (
-	// Key is the context key for the current server added to the context.
-	Key struct{}
+// presentedChallenges holds the TXT records of all challenges that are
+// presented. It is shared between all ChallengeHandlers, so a challenge is
+// answered by every server block that uses the plugin.
+var presentedChallenges challengeStore
 
-	// LoopKey is the context key to detect server wide loops.
-	LoopKey struct{}
-)
+// challengeStore holds the TXT records of the dns-01 challenges that are currently
+// presented. A name can have several values at once, because a wildcard and its
+// base domain are validated with the same record name.
+type challengeStore struct {
+	mu      sync.RWMutex
+	records map[string][]string
+}
 
-func (as *ACMEServer) ServePacket(p net.PacketConn, challenge acme.Challenge) error {
-	fmt.Println("ACMEServer Starting to serve UDP!!!!!!!!!")
-	as.m.Lock()
-	fmt.Println("Still ACMEServer Starting to serve UDP!!!!!!!!!")
-	as.server = &dns.Server{PacketConn: p, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
-		acme_request := true
-		fmt.Println("ACMEHandler Handling DNS Challenge UDP!!!!")
-		state := request.Request{W: w, Req: r}
-		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassANY, Ttl: 0}
-		m := new(dns.Msg)
-		m.SetReply(r)
-		if state.QType() != dns.TypeTXT {
-			fmt.Println("Received Wrong DNS Request")
-			acme_request = false
-		}
+// add adds the TXT record name with value.
+func (s *challengeStore) add(name, value string) {
+	name = dns.CanonicalName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records == nil {
+		s.records = make(map[string][]string)
+	}
+	s.records[name] = append(s.records[name], value)
+}
 
-		if !(strings.HasPrefix(state.Name(), "_acme-challenge")) {
-			fmt.Println("Received Something else!")
-			acme_request = false
+// remove removes one TXT record name with value.
+func (s *challengeStore) remove(name, value string) {
+	name = dns.CanonicalName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := s.records[name]
+	for i, v := range values {
+		if v == value {
+			values = append(values[:i:i], values[i+1:]...)
+			break
 		}
+	}
+	if len(values) == 0 {
+		delete(s.records, name)
+		return
+	}
+	s.records[name] = values
+}
 
-		if acme_request {
-			fmt.Println("Received ACME Challenge!")
-			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{challenge.DNS01KeyAuthorization()}})
-			fmt.Println(m)
-			w.WriteMsg(m)
-			fmt.Println("Done handling ACME Challenge UDP!!!!")
-		} else {
-			fmt.Println("Ignoring DNS request:", state.Name())
-		}
-	})}
-	as.m.Unlock()
+// lookup returns the values of the TXT records with name.
+func (s *challengeStore) lookup(name string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.records[dns.CanonicalName(name)]...)
+}
+
+// empty returns true if no challenge is presented.
+func (s *challengeStore) empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.records) == 0
+}
+
+// challengeRecordName returns the name of the TXT record for the dns-01 challenge.
+// For a wildcard this is the record of its base domain. DNS01TXTRecordName already
+// returns that name as long as the CA follows RFC 8555 and leaves the wildcard
+// label off the identifier, the label is stripped for CAs that do not.
+func challengeRecordName(challenge acme.Challenge) string {
+	name := challenge.DNS01TXTRecordName()
+	name = strings.Replace(name, "_acme-challenge.*.", "_acme-challenge.", 1)
+	return dns.CanonicalName(name)
+}
 
-	return as.server.ActivateAndServe()
+// challengeKey returns the key of the TXT record of challenge, which
+// tells apart the challenges of a wildcard and its base domain.
+func challengeKey(challenge acme.Challenge) string {
+	return challengeRecordName(challenge) + " " + challenge.DNS01KeyAuthorization()
+}
+
+// followCNAMEs returns the name at the end of the CNAME chain starting
+// at name, as looked up at resolver. If name is not a CNAME, it is
+// returned as is.
+func followCNAMEs(ctx context.Context, resolver, name string) (string, error) {
+	seen := map[string]bool{name: true}
+	for i := 0; i < maxCNAMEs; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeCNAME)
+		r, err := exchange(ctx, resolver, m)
+		if err != nil {
+			return "", fmt.Errorf("looking up CNAME of %s: %v", name, err)
+		}
+		target := ""
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		if seen[target] {
+			return "", fmt.Errorf("CNAME loop at %s", target)
+		}
+		seen[target] = true
+		name = target
+	}
+	return "", fmt.Errorf("more than %d CNAMEs to follow from %s", maxCNAMEs, name)
 }
 
 // Present is called just before a challenge is initiated.
 // The implementation MUST prepare anything that is necessary
 // for completing the challenge
-// for CoreDNS that means that we need to start the DNS Server,
-// serve exactly one request and
+// for CoreDNS that means that we need to add the TXT record
+// that the ChallengeHandler serves.
 func (d *DNSSolver) Present(ctx context.Context, challenge acme.Challenge) error {
-	fmt.Println("Starting to solve the challenge!")
-	var config []*dnsserver.Config
-	config = append(config, d.Config)
+	name := challengeRecordName(challenge)
+	if d.Addr != "" {
+		target, err := followCNAMEs(ctx, d.Addr, name)
+		if err != nil {
+			return err
+		}
+		name = target
+	}
 
-	as := NewACMEServer(d.Addr)
-	d.DNS = as
+	d.targetsMu.Lock()
+	if d.targets == nil {
+		d.targets = make(map[string]string)
+	}
+	d.targets[challengeKey(challenge)] = name
+	d.targetsMu.Unlock()
 
-	addr := net.UDPAddr{
-		Port: 53,
-		IP:   net.ParseIP("0.0.0.0"),
+	log.Debugf("Presenting TXT record %s", name)
+	presentedChallenges.add(name, challenge.DNS01KeyAuthorization())
+	return nil
+}
+
+// target returns the name the TXT record of challenge is published at.
+func (d *DNSSolver) target(challenge acme.Challenge) string {
+	d.targetsMu.Lock()
+	defer d.targetsMu.Unlock()
+	if name, ok := d.targets[challengeKey(challenge)]; ok {
+		return name
 	}
+	return challengeRecordName(challenge)
+}
 
-	// l, err := net.Listen("tcp", d.Addr)
-	l, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		fmt.Println("Failed to create Listener")
-		fmt.Println(err)
+// Wait blocks until the TXT record of the challenge is published, which
+// is checked with backoff until PropagationTimeout or until ctx is done.
+func (d *DNSSolver) Wait(ctx context.Context, challenge acme.Challenge) error {
+	return d.waitPublished(ctx, d.target(challenge), challenge.DNS01KeyAuthorization())
+}
+
+// waitPublished blocks until the TXT record name with value is published.
+func (d *DNSSolver) waitPublished(ctx context.Context, name, value string) error {
+	timeout := d.PropagationTimeout
+	if timeout <= 0 {
+		timeout = DefaultPropagationTimeout
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	go func() {
-		err := as.ServePacket(l, challenge)
+	backoff := propagationInitialBackoff
+	for {
+		err := d.checkPublished(ctx, name, value)
+		if err == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("TXT record %s not published: %v (%v)", name, err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > propagationMaxBackoff {
+			backoff = propagationMaxBackoff
+		}
+	}
+}
+
+// checkPublished returns nil if the TXT record name with value is served by
+// the local server and, if configured, by all authoritative nameservers.
+// With nameserversOnly, it is only checked at the nameservers.
+func (d *DNSSolver) checkPublished(ctx context.Context, name, value string) error {
+	var servers []string
+	if !d.nameserversOnly {
+		servers = append(servers, d.Addr)
+	}
+	if d.CheckNameservers || d.nameserversOnly {
+		nameservers, err := d.nameservers(ctx, name)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, nameservers...)
+	}
+
+	for _, server := range servers {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		r, err := exchange(ctx, server, m)
 		if err != nil {
-			fmt.Println("Received Error from ServePacket")
-			fmt.Println(err)
+			return err
+		}
+		if !hasTXT(r, value) {
+			return fmt.Errorf("%s does not serve the TXT record yet", server)
 		}
-		fmt.Println("ACME DNS Server has been shutdown!")
-	}()
-	fmt.Println("DNS Server should be up")
+	}
 	return nil
 }
 
-func (d *DNSSolver) Wait(ctx context.Context, challenge acme.Challenge) error {
-	fmt.Println("We Waitin")
-	time.Sleep(10 * time.Second)
-	return nil
+// nameservers returns the addresses of the authoritative nameservers of the zone
+// name is in. The zone's NS set and the nameservers' addresses are looked up at the
+// local server, which is authoritative for the zone. Addresses it does not know
+// are resolved by the system resolver.
+func (d *DNSSolver) nameservers(ctx context.Context, name string) ([]string, error) {
+	port := d.nameserverPort
+	if port == "" {
+		port = "53"
+	}
+
+	var hosts []string
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		m := new(dns.Msg)
+		m.SetQuestion(name[off:], dns.TypeNS)
+		r, err := exchange(ctx, d.Addr, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range r.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				hosts = append(hosts, ns.Ns)
+			}
+		}
+		if len(hosts) > 0 {
+			break
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no NS records found for %s", name)
+	}
+
+	var addrs []string
+	for _, host := range hosts {
+		ips, err := d.lookupHost(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolving nameserver %s: %v", host, err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs, nil
+}
+
+// lookupHost returns the addresses of host.
+func (d *DNSSolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	var ips []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		r, err := exchange(ctx, d.Addr, m)
+		if err != nil {
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	return net.DefaultResolver.LookupHost(ctx, strings.TrimSuffix(host, "."))
+}
+
+// exchange sends m to server and returns the reply, retrying
+// over TCP if the reply is truncated.
+func exchange(ctx context.Context, server string, m *dns.Msg) (*dns.Msg, error) {
+	c := new(dns.Client)
+	r, _, err := c.ExchangeContext(ctx, m, server)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.ExchangeContext(ctx, m, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// hasTXT returns true if r answers with a TXT record with value.
+func hasTXT(r *dns.Msg, value string) bool {
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
 }
 
 // CleanUp is called after a challenge is finished, whether
@@ -131,11 +360,11 @@ func (d *DNSSolver) Wait(ctx context.Context, challenge acme.Challenge) error {
 // allocated/created during Present. It SHOULD NOT require
 // that Present ran successfully. It MUST return quickly.
 func (d *DNSSolver) CleanUp(ctx context.Context, challenge acme.Challenge) error {
-	fmt.Println("Cleaning Up!")
-	err := d.DNS.server.Shutdown()
-	if err != nil {
-		fmt.Println("Error shutting down")
-		fmt.Println(err)
-	}
+	name := d.target(challenge)
+	d.targetsMu.Lock()
+	delete(d.targets, challengeKey(challenge))
+	d.targetsMu.Unlock()
+
+	presentedChallenges.remove(name, challenge.DNS01KeyAuthorization())
 	return nil
 }
@@ -0,0 +1,247 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+func TestChallengeRecordName(t *testing.T) {
+	tests := []struct {
+		identifier string
+		expected   string
+	}{
+		{"example.com", "_acme-challenge.example.com."},
+		{"Example.com.", "_acme-challenge.example.com."},
+		{"dns.example.com", "_acme-challenge.dns.example.com."},
+		// the identifier of a wildcard authorization is its base domain,
+		// some CAs leave the wildcard label on it nonetheless
+		{"*.example.com", "_acme-challenge.example.com."},
+	}
+
+	for i, test := range tests {
+		challenge := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: test.identifier}}
+		if name := challengeRecordName(challenge); name != test.expected {
+			t.Errorf("Test %d: Expected record name %s, got %s", i, test.expected, name)
+		}
+	}
+}
+
+func TestChallengeStoreWildcardAndBase(t *testing.T) {
+	// a wildcard and its base domain share the same record name, so
+	// both values have to be served at the same time
+	wildcard := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: "example.com"}, KeyAuthorization: "wildcard"}
+	base := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: "example.com"}, KeyAuthorization: "base"}
+
+	var s challengeStore
+	s.add(challengeRecordName(wildcard), wildcard.DNS01KeyAuthorization())
+	s.add(challengeRecordName(base), base.DNS01KeyAuthorization())
+
+	expected := []string{wildcard.DNS01KeyAuthorization(), base.DNS01KeyAuthorization()}
+	if values := s.lookup("_acme-challenge.EXAMPLE.com"); !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected values %v, got %v", expected, values)
+	}
+
+	s.remove(challengeRecordName(wildcard), wildcard.DNS01KeyAuthorization())
+	expected = []string{base.DNS01KeyAuthorization()}
+	if values := s.lookup("_acme-challenge.example.com."); !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected values %v after removing the wildcard, got %v", expected, values)
+	}
+
+	s.remove(challengeRecordName(base), base.DNS01KeyAuthorization())
+	if !s.empty() {
+		t.Errorf("Expected store to be empty, got %v", s.records)
+	}
+}
+
+// newTestDNSServer serves h over UDP on addr and returns the address it listens on.
+func newTestDNSServer(t *testing.T, addr string, h dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %s", addr, err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// zoneHandler answers for the zone example.com with the nameservers
+// ns1.example.com at 127.0.0.1 and ns2.example.com at 127.0.0.2. The
+// challenges are answered by the ChallengeHandler. The challenges of
+// delegated.example.com are delegated by CNAME to the validation zone
+// auth.example.com, those of loop.example.com end in a CNAME loop.
+func zoneHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	switch {
+	case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+		m.Answer = append(m.Answer,
+			test.NS("example.com. 3600 IN NS ns1.example.com."),
+			test.NS("example.com. 3600 IN NS ns2.example.com."),
+		)
+	case q.Qtype == dns.TypeA && q.Name == "ns1.example.com.":
+		m.Answer = append(m.Answer, test.A("ns1.example.com. 3600 IN A 127.0.0.1"))
+	case q.Qtype == dns.TypeA && q.Name == "ns2.example.com.":
+		m.Answer = append(m.Answer, test.A("ns2.example.com. 3600 IN A 127.0.0.2"))
+	case q.Qtype == dns.TypeCNAME && q.Name == "_acme-challenge.delegated.example.com.":
+		m.Answer = append(m.Answer, test.CNAME("_acme-challenge.delegated.example.com. 3600 IN CNAME Delegated.auth.example.com."))
+	case q.Qtype == dns.TypeCNAME && q.Name == "_acme-challenge.loop.example.com.":
+		m.Answer = append(m.Answer, test.CNAME("_acme-challenge.loop.example.com. 3600 IN CNAME loop.auth.example.com."))
+	case q.Qtype == dns.TypeCNAME && q.Name == "loop.auth.example.com.":
+		m.Answer = append(m.Answer, test.CNAME("loop.auth.example.com. 3600 IN CNAME _acme-challenge.loop.example.com."))
+	case q.Qtype == dns.TypeTXT && len(presentedChallenges.lookup(q.Name)) > 0:
+		ChallengeHandler{}.ServeDNS(context.Background(), w, r)
+		return
+	}
+	w.WriteMsg(m)
+}
+
+func TestDNSSolverWait(t *testing.T) {
+	addr := newTestDNSServer(t, "127.0.0.1:0", zoneHandler)
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	solver := &DNSSolver{Addr: addr, PropagationTimeout: 5 * time.Second}
+
+	if err := solver.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	if err := solver.Wait(context.Background(), challenge); err != nil {
+		t.Errorf("Expected presented challenge to be published, got: %s", err)
+	}
+	solver.CleanUp(context.Background(), challenge)
+
+	solver.PropagationTimeout = 500 * time.Millisecond
+	err := solver.Wait(context.Background(), challenge)
+	if err == nil || !strings.Contains(err.Error(), "not published") {
+		t.Errorf("Expected challenge that is not presented to time out, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	solver.PropagationTimeout = time.Minute
+	start := time.Now()
+	if err := solver.Wait(ctx, challenge); err == nil {
+		t.Error("Expected error for cancelled context")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected Wait to honor the cancelled context, took %s", time.Since(start))
+	}
+}
+
+func TestDNSSolverWaitNameservers(t *testing.T) {
+	addr := newTestDNSServer(t, "127.0.0.1:0", zoneHandler)
+	_, port, _ := net.SplitHostPort(addr)
+
+	// the secondary ns2.example.com only serves the record once it is in sync
+	var synced int32
+	newTestDNSServer(t, net.JoinHostPort("127.0.0.2", port), func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.LoadInt32(&synced) == 1 {
+			zoneHandler(w, r)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	solver := &DNSSolver{
+		Addr:               addr,
+		PropagationTimeout: 500 * time.Millisecond,
+		CheckNameservers:   true,
+		nameserverPort:     port,
+	}
+	solver.Present(context.Background(), challenge)
+	defer solver.CleanUp(context.Background(), challenge)
+
+	err := solver.Wait(context.Background(), challenge)
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.2") {
+		t.Errorf("Expected secondary that is not in sync to fail the check, got: %v", err)
+	}
+
+	time.AfterFunc(300*time.Millisecond, func() { atomic.StoreInt32(&synced, 1) })
+	solver.PropagationTimeout = 5 * time.Second
+	if err := solver.Wait(context.Background(), challenge); err != nil {
+		t.Errorf("Expected challenge to be published once the secondary is in sync, got: %s", err)
+	}
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	addr := newTestDNSServer(t, "127.0.0.1:0", zoneHandler)
+
+	tests := []struct {
+		name               string
+		expected           string
+		expectedErrContent string // substring from the expected error. Empty for positive cases.
+	}{
+		{"_acme-challenge.example.com.", "_acme-challenge.example.com.", ""},
+		{"_acme-challenge.delegated.example.com.", "delegated.auth.example.com.", ""},
+		{"_acme-challenge.loop.example.com.", "", "CNAME loop"},
+	}
+
+	for i, tc := range tests {
+		name, err := followCNAMEs(context.Background(), addr, tc.name)
+		if tc.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain %q, got %v", i, tc.expectedErrContent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %s", i, err)
+			continue
+		}
+		if name != tc.expected {
+			t.Errorf("Test %d: Expected name %s, got %s", i, tc.expected, name)
+		}
+	}
+}
+
+func TestDNSSolverCNAME(t *testing.T) {
+	addr := newTestDNSServer(t, "127.0.0.1:0", zoneHandler)
+	challenge := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "dns", Value: "delegated.example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	solver := &DNSSolver{Addr: addr, PropagationTimeout: 5 * time.Second}
+
+	if err := solver.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+	if values := presentedChallenges.lookup("delegated.auth.example.com."); len(values) != 1 {
+		t.Errorf("Expected the TXT record at the CNAME target, got %v", values)
+	}
+	if values := presentedChallenges.lookup("_acme-challenge.delegated.example.com."); len(values) != 0 {
+		t.Errorf("Expected no TXT record at the CNAME, got %v", values)
+	}
+	if err := solver.Wait(context.Background(), challenge); err != nil {
+		t.Errorf("Expected presented challenge to be published, got: %s", err)
+	}
+
+	solver.CleanUp(context.Background(), challenge)
+	if !presentedChallenges.empty() {
+		t.Errorf("Expected no challenges after clean up, got %v", presentedChallenges.records)
+	}
+
+	loop := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: "loop.example.com"}}
+	if err := solver.Present(context.Background(), loop); err == nil {
+		t.Error("Expected error for a CNAME loop")
+	}
+}
@@ -1,6 +1,11 @@
 package acme
 
-import "context"
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+)
 
 type Storage interface {
 	// Locker provides atomic synchronization
@@ -10,7 +15,9 @@ type Storage interface {
 	// Store puts value at key.
 	Store(ctx context.Context, key string, value []byte) error
 
-	// Load retrieves the value at key.
+	// Load retrieves the value at key. The error must
+	// satisfy errors.Is(err, fs.ErrNotExist) if the key
+	// does not exist.
 	Load(ctx context.Context, key string) ([]byte, error)
 
 	// Delete deletes key. An error should be
@@ -28,6 +35,22 @@ type Storage interface {
 	// should be walked); otherwise, only keys
 	// prefixed exactly by prefix will be listed.
 	List(ctx context.Context, prefix string, recursive bool) ([]string, error)
+
+	// Stat returns information about key. The error must
+	// satisfy errors.Is(err, fs.ErrNotExist) if the key
+	// does not exist.
+	Stat(ctx context.Context, key string) (KeyInfo, error)
+}
+
+// KeyInfo holds information about a key in storage.
+type KeyInfo struct {
+	Key      string
+	Modified time.Time
+	Size     int64
+
+	// IsTerminal is false for keys that only
+	// contain other keys, like directories.
+	IsTerminal bool
 }
 
 // Locker facilitates synchronization of certificate tasks across
@@ -61,3 +84,27 @@ type Locker interface {
 	// out. Unlock cleans up any resources allocated during Lock.
 	Unlock(ctx context.Context, key string) error
 }
+
+// issuerKey returns a storage key segment for the CA with the
+// directory URL ca, such as "acme-v02.api.letsencrypt.org-directory".
+func issuerKey(ca string) string {
+	key := ca
+	if u, err := url.Parse(ca); err == nil && u.Host != "" {
+		key = u.Host + u.Path
+	}
+	return safeKey(strings.Trim(strings.ReplaceAll(key, "/", "-"), "-"))
+}
+
+// safeKey makes str safe to use as a single storage key segment.
+func safeKey(str string) string {
+	str = strings.ToLower(strings.TrimSpace(str))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '.', r == '@', r == '+', r == '*':
+			return r
+		}
+		return '_'
+	}, str)
+}
@@ -0,0 +1,46 @@
+package acme_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/mariuskimmina/tlsplus/acme/storagetest"
+)
+
+func TestFileStorageConformance(t *testing.T) {
+	acme.ShortenLockPollInterval(t)
+	dir := t.TempDir()
+	storagetest.Test(t, acme.NewFileStorage(dir), func() acme.Storage {
+		return acme.NewFileStorage(dir)
+	})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	// a MemoryStorage is only shared within a process
+	s := acme.NewMemoryStorage()
+	storagetest.Test(t, s, func() acme.Storage { return s })
+}
+
+func TestEncryptedStorageConformance(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, acme.EncryptionKeySize)
+	encrypt := func(t *testing.T, storage acme.Storage) acme.Storage {
+		s, err := acme.NewEncryptedStorage(storage, key)
+		if err != nil {
+			t.Fatalf("Failed to create encrypted storage: %s", err)
+		}
+		return s
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		s := encrypt(t, acme.NewMemoryStorage())
+		storagetest.Test(t, s, func() acme.Storage { return s })
+	})
+	t.Run("File", func(t *testing.T) {
+		acme.ShortenLockPollInterval(t)
+		dir := t.TempDir()
+		storagetest.Test(t, encrypt(t, acme.NewFileStorage(dir)), func() acme.Storage {
+			return encrypt(t, acme.NewFileStorage(dir))
+		})
+	})
+}
@@ -0,0 +1,266 @@
+// Package storagetest provides the conformance tests every acme.Storage
+// implementation has to pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mariuskimmina/tlsplus/acme"
+)
+
+// Test runs the conformance tests against s, which has to be empty. newReplica
+// returns another Storage with the same backend as s, like the storage of
+// another CoreDNS instance sharing it.
+func Test(t *testing.T, s acme.Storage, newReplica func() acme.Storage) {
+	// every test uses its own keys, as they share the backend
+	t.Run("Load", func(t *testing.T) { testLoad(t, s) })
+	t.Run("Stat", func(t *testing.T) { testStat(t, s) })
+	t.Run("List", func(t *testing.T) { testList(t, s) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, s) })
+	t.Run("Lock", func(t *testing.T) { testLock(t, s, newReplica) })
+	t.Run("LockContext", func(t *testing.T) { testLockContext(t, s, newReplica) })
+}
+
+func testLoad(t *testing.T, s acme.Storage) {
+	ctx := context.Background()
+	key := "acme/load/users/admin/account.json"
+
+	if _, err := s.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for missing key, got: %v", err)
+	}
+	if s.Exists(ctx, key) {
+		t.Errorf("Expected missing key not to exist")
+	}
+
+	for _, value := range []string{"value", "replaced value"} {
+		if err := s.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("Failed to store %s: %s", key, err)
+		}
+		loaded, err := s.Load(ctx, key)
+		if err != nil || string(loaded) != value {
+			t.Errorf("Expected %q, got %q: %v", value, loaded, err)
+		}
+	}
+	if !s.Exists(ctx, key) {
+		t.Errorf("Expected stored key to exist")
+	}
+}
+
+func testStat(t *testing.T, s acme.Storage) {
+	ctx := context.Background()
+	key := "certificates/stat/example.com/example.com.crt"
+
+	if _, err := s.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for missing key, got: %v", err)
+	}
+
+	before := time.Now().Add(-time.Minute)
+	if err := s.Store(ctx, key, []byte("certificate")); err != nil {
+		t.Fatalf("Failed to store %s: %s", key, err)
+	}
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %s", key, err)
+	}
+	if info.Key != key || !info.IsTerminal || info.Size != int64(len("certificate")) || info.Modified.Before(before) {
+		t.Errorf("Unexpected key info %+v", info)
+	}
+
+	// keys that contain other keys exist as well
+	for _, dir := range []string{"certificates/stat", "certificates/stat/example.com"} {
+		info, err := s.Stat(ctx, dir)
+		if err != nil || info.IsTerminal {
+			t.Errorf("Expected non-terminal key info for %s, got %+v: %v", dir, info, err)
+		}
+		if !s.Exists(ctx, dir) {
+			t.Errorf("Expected %s to exist", dir)
+		}
+	}
+}
+
+func testList(t *testing.T, s acme.Storage) {
+	ctx := context.Background()
+
+	if _, err := s.List(ctx, "certificates/list", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for missing prefix, got: %v", err)
+	}
+
+	for _, key := range []string{
+		"certificates/list/example.com/example.com.crt",
+		"certificates/list/example.com/example.com.key",
+		"certificates/list/example.com/example.com.json",
+		"certificates/list/example.org/example.org.crt",
+		"certificates/list/example.org/example.org.key",
+	} {
+		if err := s.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Failed to store %s: %s", key, err)
+		}
+	}
+
+	tests := []struct {
+		prefix    string
+		recursive bool
+		expected  []string
+	}{
+		{"certificates/list", false, []string{
+			"certificates/list/example.com",
+			"certificates/list/example.org",
+		}},
+		{"certificates/list/example.com", false, []string{
+			"certificates/list/example.com/example.com.crt",
+			"certificates/list/example.com/example.com.json",
+			"certificates/list/example.com/example.com.key",
+		}},
+		{"certificates/list", true, []string{
+			"certificates/list/example.com",
+			"certificates/list/example.com/example.com.crt",
+			"certificates/list/example.com/example.com.json",
+			"certificates/list/example.com/example.com.key",
+			"certificates/list/example.org",
+			"certificates/list/example.org/example.org.crt",
+			"certificates/list/example.org/example.org.key",
+		}},
+	}
+	for i, test := range tests {
+		keys, err := s.List(ctx, test.prefix, test.recursive)
+		if err != nil {
+			t.Errorf("Test %d: Failed to list %s: %s", i, test.prefix, err)
+			continue
+		}
+		if !reflect.DeepEqual(sorted(keys), test.expected) {
+			t.Errorf("Test %d: Expected keys %v, got %v", i, test.expected, keys)
+		}
+	}
+
+	// the empty prefix lists the top level of the storage, which
+	// may hold the keys of the other tests as well
+	keys, err := s.List(ctx, "", false)
+	if err != nil {
+		t.Fatalf("Failed to list the top level: %s", err)
+	}
+	found := false
+	for _, key := range keys {
+		if strings.Contains(key, "/") {
+			t.Errorf("Expected only top level keys, got %s", key)
+		}
+		found = found || key == "certificates"
+	}
+	if !found {
+		t.Errorf("Expected the top level to contain certificates, got %v", keys)
+	}
+}
+
+func testDelete(t *testing.T, s acme.Storage) {
+	ctx := context.Background()
+	key := "acme/delete/users/admin/account.key"
+	other := "acme/delete/users/admin/account.json"
+
+	if err := s.Store(ctx, key, []byte("key")); err != nil {
+		t.Fatalf("Failed to store %s: %s", key, err)
+	}
+	if err := s.Store(ctx, other, []byte("account")); err != nil {
+		t.Fatalf("Failed to store %s: %s", other, err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Failed to delete %s: %s", key, err)
+	}
+	if _, err := s.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for deleted key, got: %v", err)
+	}
+	if !s.Exists(ctx, other) {
+		t.Errorf("Expected other key to be left alone")
+	}
+
+	// a key that does not exist is deleted already
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Expected no error deleting a missing key, got: %s", err)
+	}
+}
+
+func testLock(t *testing.T, s acme.Storage, newReplica func() acme.Storage) {
+	ctx := context.Background()
+	const replicas, iterations = 5, 5
+	key := "certificates/lock/example.com/issue"
+
+	var inside int32
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		replica := s
+		if i > 0 {
+			replica = newReplica()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := replica.Lock(ctx, key); err != nil {
+					t.Errorf("Failed to lock: %s", err)
+					return
+				}
+				if n := atomic.AddInt32(&inside, 1); n != 1 {
+					t.Errorf("Expected only one holder of the lock, got %d", n)
+				}
+				counter++
+				atomic.AddInt32(&inside, -1)
+				if err := replica.Unlock(ctx, key); err != nil {
+					t.Errorf("Failed to unlock: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != replicas*iterations {
+		t.Errorf("Expected counter %d, got %d", replicas*iterations, counter)
+	}
+}
+
+func testLockContext(t *testing.T, s acme.Storage, newReplica func() acme.Storage) {
+	ctx := context.Background()
+	key := "certificates/lockcontext/example.com/issue"
+	if err := s.Lock(ctx, key); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+
+	// waiting for the lock held by s is given up once the context is done
+	replica := newReplica()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := replica.Lock(timeoutCtx, key); err == nil {
+		t.Errorf("Expected error locking a held lock until the context is done")
+		replica.Unlock(ctx, key)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected Lock to honor the context, took %s", time.Since(start))
+	}
+
+	// the lock is obtained once released
+	if err := s.Unlock(ctx, key); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := replica.Lock(timeoutCtx, key); err != nil {
+		t.Fatalf("Failed to lock released lock: %s", err)
+	}
+	replica.Unlock(ctx, key)
+}
+
+// sorted returns keys in order, as storages list them in any order.
+func sorted(keys []string) []string {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	return keys
+}
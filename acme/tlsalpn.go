@@ -0,0 +1,95 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// TLSALPNSolver solves tls-alpn-01 challenges on the TLS listeners of CoreDNS.
+// The challenge certificates are served by GetConfigForClient, which has to be
+// set on the tls.Config of the listeners. The CA connects on port 443, so a
+// server block has to serve DNS-over-HTTPS or DNS-over-TLS on that port.
+type TLSALPNSolver struct{}
+
+// presentedCertificates holds the certificates of all tls-alpn-01 challenges
+// that are presented. Like presentedChallenges, it is shared between all server
+// blocks, so a challenge is answered on every TLS listener that uses the plugin.
+var presentedCertificates challengeCertStore
+
+// challengeCertStore holds the certificates of the tls-alpn-01
+// challenges that are currently presented, by domain name.
+type challengeCertStore struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// add serves cert for the challenges of name.
+func (s *challengeCertStore) add(name string, cert *tls.Certificate) {
+	name = strings.ToLower(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs == nil {
+		s.certs = make(map[string]*tls.Certificate)
+	}
+	s.certs[name] = cert
+}
+
+// remove stops serving the certificate for name.
+func (s *challengeCertStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.certs, strings.ToLower(name))
+}
+
+// lookup returns the certificate for the challenge of name, or nil.
+func (s *challengeCertStore) lookup(name string) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certs[strings.ToLower(name)]
+}
+
+// Present makes GetConfigForClient answer the challenge.
+func (TLSALPNSolver) Present(_ context.Context, challenge acme.Challenge) error {
+	cert, err := acmez.TLSALPN01ChallengeCert(challenge)
+	if err != nil {
+		return fmt.Errorf("creating challenge certificate: %v", err)
+	}
+	presentedCertificates.add(challenge.Identifier.Value, cert)
+	return nil
+}
+
+// CleanUp stops answering the challenge.
+func (TLSALPNSolver) CleanUp(_ context.Context, challenge acme.Challenge) error {
+	presentedCertificates.remove(challenge.Identifier.Value)
+	return nil
+}
+
+// GetConfigForClient answers the tls-alpn-01 challenges presented by
+// TLSALPNSolver. It returns nil for all other handshakes, so that they
+// use the listener's configuration. It can be used as
+// tls.Config.GetConfigForClient.
+func GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !isChallengeHandshake(hello) {
+		return nil, nil
+	}
+	cert := presentedCertificates.lookup(hello.ServerName)
+	if cert == nil {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge presented for %q", hello.ServerName)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{acmez.ACMETLS1Protocol},
+	}, nil
+}
+
+// isChallengeHandshake returns true if hello is the
+// handshake of a CA validating a tls-alpn-01 challenge.
+func isChallengeHandshake(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmez.ACMETLS1Protocol
+}
@@ -0,0 +1,97 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"testing"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// idPeAcmeIdentifier is the OID of the extension holding
+// the key authorization in tls-alpn-01 challenge certificates.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// testHandshake runs a handshake with a server using config and returns
+// the connection state of the client offering protos for serverName.
+func testHandshake(t *testing.T, config *tls.Config, serverName string, protos []string) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, config).Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	})
+	err := client.Handshake()
+	return client.ConnectionState(), err
+}
+
+func TestTLSALPNSolver(t *testing.T) {
+	certPEM, keyPEM := newTestKeyPair(t, "example.com")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		NextProtos:         []string{"h2", "dot"},
+		GetConfigForClient: GetConfigForClient,
+	}
+	challenge := acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}
+
+	var solver TLSALPNSolver
+	if err := solver.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Failed to present challenge: %s", err)
+	}
+
+	state, err := testHandshake(t, config, "Example.com", []string{acmez.ACMETLS1Protocol})
+	if err != nil {
+		t.Fatalf("Expected challenge handshake to succeed: %s", err)
+	}
+	if state.NegotiatedProtocol != acmez.ACMETLS1Protocol {
+		t.Errorf("Expected protocol %s, got %q", acmez.ACMETLS1Protocol, state.NegotiatedProtocol)
+	}
+	if !hasCriticalExtension(state.PeerCertificates[0], idPeAcmeIdentifier) {
+		t.Errorf("Expected challenge certificate with the acmeIdentifier extension")
+	}
+
+	// all other handshakes are served by the listener's configuration
+	state, err = testHandshake(t, config, "example.com", []string{"dot"})
+	if err != nil {
+		t.Fatalf("Expected regular handshake to succeed: %s", err)
+	}
+	if state.NegotiatedProtocol != "dot" || hasCriticalExtension(state.PeerCertificates[0], idPeAcmeIdentifier) {
+		t.Errorf("Expected regular certificate to be served")
+	}
+
+	if _, err := testHandshake(t, config, "other.example.com", []string{acmez.ACMETLS1Protocol}); err == nil {
+		t.Errorf("Expected challenge handshake for a name without challenge to fail")
+	}
+	solver.CleanUp(context.Background(), challenge)
+	if _, err := testHandshake(t, config, "example.com", []string{acmez.ACMETLS1Protocol}); err == nil {
+		t.Errorf("Expected challenge handshake to fail once cleaned up")
+	}
+}
+
+func hasCriticalExtension(cert *x509.Certificate, id asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(id) {
+			return ext.Critical
+		}
+	}
+	return false
+}
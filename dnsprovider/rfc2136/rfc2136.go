@@ -0,0 +1,129 @@
+// Package rfc2136 implements a libdns provider that publishes records
+// with RFC 2136 dynamic updates, signed with TSIG.
+package rfc2136
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/miekg/dns"
+)
+
+// DefaultKeyAlgorithm is the TSIG algorithm used if none is configured.
+const DefaultKeyAlgorithm = dns.HmacSHA256
+
+// Provider sends dynamic updates to the primary nameserver of a zone. The
+// updates are signed with TSIG if KeyName is set.
+type Provider struct {
+	// Server is the address of the primary nameserver, e.g. "ns1.example.com:53".
+	Server string
+
+	// KeyName is the name of the TSIG key, KeyAlgorithm its algorithm,
+	// e.g. "hmac-sha256", and Key the base64 encoded secret.
+	KeyName      string
+	KeyAlgorithm string
+	Key          string
+
+	// Timeout is how long to wait for the server to answer an update.
+	Timeout time.Duration
+}
+
+// AppendRecords adds recs to zone.
+func (p *Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := toRRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Insert(rrs)
+	if err := p.update(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// DeleteRecords deletes recs from zone.
+func (p *Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := toRRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Remove(rrs)
+	if err := p.update(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// update signs and sends the update m to the server.
+func (p *Provider) update(ctx context.Context, m *dns.Msg) error {
+	c := &dns.Client{Net: "tcp", Timeout: p.Timeout}
+	if p.KeyName != "" {
+		keyName := dns.Fqdn(p.KeyName)
+		algorithm := DefaultKeyAlgorithm
+		if p.KeyAlgorithm != "" {
+			algorithm = dns.Fqdn(strings.ToLower(p.KeyAlgorithm))
+		}
+		c.TsigSecret = map[string]string{keyName: p.Key}
+		m.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+	}
+
+	r, _, err := c.ExchangeContext(ctx, m, p.Server)
+	if err != nil {
+		return fmt.Errorf("sending update to %s: %v", p.Server, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of zone %s refused by %s: %s", m.Question[0].Name, p.Server, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// toRRs returns recs as resource records in zone.
+func toRRs(zone string, recs []libdns.Record) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, rec := range recs {
+		hdr := dns.RR_Header{
+			Name:  libdns.AbsoluteName(rec.Name, dns.Fqdn(zone)),
+			Class: dns.ClassINET,
+			Ttl:   uint32(rec.TTL / time.Second),
+		}
+		// TXT values are taken literally, rather than parsed from zone file syntax
+		if strings.EqualFold(rec.Type, "TXT") {
+			hdr.Rrtype = dns.TypeTXT
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: splitTXT(rec.Value)})
+			continue
+		}
+		value := rec.Value
+		switch strings.ToUpper(rec.Type) {
+		case "MX", "SRV", "URI":
+			value = fmt.Sprintf("%d %s", rec.Priority, value)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, hdr.Ttl, rec.Type, value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %s: %v", rec.Type, rec.Name, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// splitTXT splits value into the strings of a TXT record,
+// which are at most 255 bytes long each.
+func splitTXT(value string) []string {
+	var txt []string
+	for len(value) > 255 {
+		txt = append(txt, value[:255])
+		value = value[255:]
+	}
+	return append(txt, value)
+}
+
+// Interface guard
+var _ acme.DNSProvider = (*Provider)(nil)
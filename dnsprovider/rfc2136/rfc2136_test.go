@@ -0,0 +1,159 @@
+package rfc2136
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	testKeyName = "update-key."
+	testKey     = "c2VjcmV0IHRzaWcga2V5IGZvciB0aGUgdGVzdHM="
+)
+
+// testServer is a primary nameserver for example.com
+// that accepts updates signed with the test key.
+type testServer struct {
+	addr string
+
+	mu      sync.Mutex
+	records map[string]dns.RR // by recordKey
+}
+
+// recordKey returns the key of rr in the zone, deletions
+// come with a TTL of 0 and the class NONE.
+func recordKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Class = dns.ClassINET
+	return rr.String()
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{records: make(map[string]dns.RR)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s.addr = ln.Addr().String()
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:   ln,
+		Handler:    dns.HandlerFunc(s.serveDNS),
+		TsigSecret: map[string]string{testKeyName: testKey},
+		// the default rejects updates
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return s
+}
+
+func (s *testServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch {
+	case r.Opcode != dns.OpcodeUpdate || r.Question[0].Name != "example.com.":
+		m.Rcode = dns.RcodeRefused
+	case r.IsTsig() == nil || w.TsigStatus() != nil:
+		m.Rcode = dns.RcodeNotAuth
+	default:
+		s.mu.Lock()
+		for _, rr := range r.Ns {
+			switch rr.Header().Class {
+			case dns.ClassINET:
+				s.records[recordKey(rr)] = rr
+			case dns.ClassNONE:
+				delete(s.records, recordKey(rr))
+			}
+		}
+		s.mu.Unlock()
+	}
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func (s *testServer) has(record string) bool {
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added, ok := s.records[recordKey(rr)]
+	return ok && added.Header().Ttl == rr.Header().Ttl
+}
+
+func TestProvider(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	p := &Provider{Server: srv.addr, KeyName: "update-key", KeyAlgorithm: "hmac-sha256", Key: testKey}
+	records := []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "key authorization", TTL: time.Minute},
+		{Type: "MX", Name: "@", Value: "mail.example.com.", Priority: 10, TTL: time.Hour},
+	}
+	expected := []string{
+		`_acme-challenge.example.com. 60 IN TXT "key authorization"`,
+		`example.com. 3600 IN MX 10 mail.example.com.`,
+	}
+
+	if _, err := p.AppendRecords(ctx, "example.com.", records); err != nil {
+		t.Fatalf("Failed to append records: %s", err)
+	}
+	for _, record := range expected {
+		if !srv.has(record) {
+			t.Errorf("Expected %s to be added", record)
+		}
+	}
+
+	if _, err := p.DeleteRecords(ctx, "example.com", records[:1]); err != nil {
+		t.Fatalf("Failed to delete records: %s", err)
+	}
+	if srv.has(expected[0]) {
+		t.Errorf("Expected %s to be deleted", expected[0])
+	}
+	if !srv.has(expected[1]) {
+		t.Errorf("Expected %s to be left alone", expected[1])
+	}
+}
+
+func TestProviderRefused(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	record := []libdns.Record{{Type: "TXT", Name: "_acme-challenge", Value: "key authorization", TTL: time.Minute}}
+
+	tests := []struct {
+		provider           *Provider
+		zone               string
+		expectedErrContent string
+	}{
+		{&Provider{Server: srv.addr}, "example.com.", "NOTAUTH"},
+		{&Provider{Server: srv.addr, KeyName: "update-key", Key: "b3RoZXIga2V5"}, "example.com.", "NOTAUTH"},
+		{&Provider{Server: srv.addr, KeyName: "update-key", Key: testKey}, "example.org.", "REFUSED"},
+	}
+
+	for i, test := range tests {
+		_, err := test.provider.AppendRecords(ctx, test.zone, record)
+		if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+			t.Errorf("Test %d: Expected error containing %s, got: %v", i, test.expectedErrContent, err)
+		}
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	value := strings.Repeat("a", 300)
+	txt := splitTXT(value)
+	if len(txt) != 2 || len(txt[0]) != 255 || strings.Join(txt, "") != value {
+		t.Errorf("Expected value to be split after 255 bytes, got %d strings", len(txt))
+	}
+}
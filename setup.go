@@ -1,21 +1,48 @@
 package tlsplus
 
 import (
+	"context"
 	ctls "crypto/tls"
-	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/mariuskimmina/tlsplus/dnsprovider/rfc2136"
+	"github.com/mariuskimmina/tlsplus/storage/etcd"
+	"github.com/mariuskimmina/tlsplus/storage/kubernetes"
 	"github.com/mariuskimmina/tlsplus/tls"
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func init() { plugin.Register("tls", setup) }
 
+var log = clog.NewWithPlugin("tls")
+
+// setupTimeout bounds the requests to the storage and the CA during setup,
+// so that an unreachable one fails the setup instead of blocking it.
+var setupTimeout = time.Minute
+
+// defaultEtcdEndpoint is the etcd endpoint used by the etcd storage if none is given.
+const defaultEtcdEndpoint = "http://127.0.0.1:2379"
+
+// memoryStorage is shared by all server blocks using the memory storage,
+// and is kept across reloads like the other storages.
+var memoryStorage = acme.NewMemoryStorage()
+
 func setup(c *caddy.Controller) error {
 	err := parseTLS(c)
 	if err != nil {
@@ -25,38 +52,461 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-const (
-	acmeCertFile = "/etc/coredns/cert.pem"
-	acmeKeyFile  = "/etc/coredns/key.pem"
-)
+// normalizeDomain returns domain in the form it is put on a certificate.
+// A wildcard is only allowed as the complete leftmost label, e.g. *.example.com.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	base := strings.TrimPrefix(domain, "*.")
+	if strings.Contains(base, "*") {
+		return "", fmt.Errorf("invalid wildcard domain %q", domain)
+	}
+	if _, ok := dns.IsDomainName(base); !ok || base == "" || strings.HasPrefix(base, ".") {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	if base != domain && dns.CountLabel(base) < 2 {
+		return "", fmt.Errorf("invalid wildcard domain %q", domain)
+	}
+	return domain, nil
+}
 
-func fileExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	return false
+}
+
+// localDNSAddr returns the local address the server block serves plain DNS on,
+// which is where the records of presented challenges are checked. It depends on
+// the addresses set by the bind plugin, so it is only known once all plugins of
+// the server block are set up.
+func localDNSAddr(c *caddy.Controller) string {
+	host := localDNSHost(dnsserver.GetConfig(c).ListenHosts)
+	for _, key := range c.ServerBlockKeys {
+		trans, addr := parse.Transport(key)
+		if trans != transport.DNS {
+			continue
+		}
+		_, port, err := plugin.SplitHostPort(addr)
+		if err == nil && port != "" {
+			return net.JoinHostPort(host, port)
+		}
 	}
-	return false, err
+	return net.JoinHostPort(host, dnsserver.Port)
 }
 
-func acmeCertPresent() (bool, error) {
-	present, err := fileExists(acmeCertFile)
-	if err != nil {
-		return false, err
+// localDNSHost returns the address of hosts, the addresses a server block
+// listens on, to query it at. That is the loopback address, unless the block
+// is bound to other addresses only.
+func localDNSHost(hosts []string) string {
+	for _, host := range hosts {
+		ip := net.ParseIP(host)
+		switch {
+		case host == "" || ip != nil && ip.Equal(net.IPv4zero):
+			return "127.0.0.1"
+		case ip != nil && ip.Equal(net.IPv6unspecified):
+			return "::1"
+		case ip != nil && ip.IsLoopback():
+			return host
+		}
+	}
+	if len(hosts) > 0 {
+		return hosts[0]
 	}
-	return present, nil
+	return "127.0.0.1"
 }
 
-func acmeCertValid(cert *ctls.Certificate) (bool, error) {
-	parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
+// parseACMEConfig parses the block of a "tls acme" directive. The returned
+// function closes the client of the storage, if it has one, once the storage
+// is not used anymore.
+func parseACMEConfig(c *caddy.Controller) (_ *acme.Config, closeStorage func() error, err error) {
+	// the client is not used if the block is invalid
+	var etcdClient *clientv3.Client
+	defer func() {
+		if err != nil && etcdClient != nil {
+			etcdClient.Close()
+		}
+	}()
+
+	acmeConfig := acme.NewConfig(nil, nil)
+	acmeConfig.LocalDNSAddr = localDNSAddr(c)
+	var encryptionKey []byte
+	for c.NextBlock() {
+		switch c.Val() {
+		case "domain":
+			domainArgs := c.RemainingArgs()
+			if len(domainArgs) == 0 {
+				return nil, nil, c.ArgErr()
+			}
+			for _, domain := range domainArgs {
+				domain, err := normalizeDomain(domain)
+				if err != nil {
+					return nil, nil, c.Err(err.Error())
+				}
+				if !containsString(acmeConfig.Domains, domain) {
+					acmeConfig.Domains = append(acmeConfig.Domains, domain)
+				}
+			}
+		case "ca":
+			caArgs := c.RemainingArgs()
+			if len(caArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			ca, err := acme.CADirectoryURL(caArgs[0])
+			if err != nil {
+				return nil, nil, c.Err(err.Error())
+			}
+			acmeConfig.CA = ca
+		case "email":
+			emailArgs := c.RemainingArgs()
+			if len(emailArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			acmeConfig.Email = emailArgs[0]
+		case "agree_tos":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, nil, c.ArgErr()
+			}
+			acmeConfig.AgreeTOS = true
+		case "eab_key_id":
+			eabArgs := c.RemainingArgs()
+			if len(eabArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			acmeConfig.EABKeyID = eabArgs[0]
+		case "eab_hmac_key":
+			eabArgs := c.RemainingArgs()
+			if len(eabArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			if _, err := base64.RawURLEncoding.DecodeString(eabArgs[0]); err != nil {
+				return nil, nil, c.Errf("eab_hmac_key must be base64url encoded: %v", err)
+			}
+			acmeConfig.EABHMACKey = eabArgs[0]
+		case "propagation_timeout":
+			timeoutArgs := c.RemainingArgs()
+			if len(timeoutArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			timeout, err := time.ParseDuration(timeoutArgs[0])
+			if err != nil || timeout <= 0 {
+				return nil, nil, c.Errf("invalid propagation_timeout '%s'", timeoutArgs[0])
+			}
+			acmeConfig.PropagationTimeout = timeout
+		case "propagation_check_nameservers":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, nil, c.ArgErr()
+			}
+			acmeConfig.CheckNameservers = true
+		case "ca_root":
+			caRootArgs := c.RemainingArgs()
+			if len(caRootArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			roots, err := tls.LoadRoots(caRootArgs[0])
+			if err != nil {
+				return nil, nil, c.Err(err.Error())
+			}
+			acmeConfig.TrustedRoots = roots
+		case "insecure_skip_verify":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, nil, c.ArgErr()
+			}
+			acmeConfig.InsecureSkipVerify = true
+		case "storage":
+			storageArgs := c.RemainingArgs()
+			if len(storageArgs) == 0 {
+				return nil, nil, c.ArgErr()
+			}
+			switch storageArgs[0] {
+			case "file":
+				if len(storageArgs) != 2 {
+					return nil, nil, c.ArgErr()
+				}
+				acmeConfig.Storage = acme.NewFileStorage(storageArgs[1])
+			case "memory":
+				if len(storageArgs) != 1 {
+					return nil, nil, c.ArgErr()
+				}
+				acmeConfig.Storage = memoryStorage
+			case "etcd":
+				endpoints := storageArgs[1:]
+				if len(endpoints) == 0 {
+					endpoints = []string{defaultEtcdEndpoint}
+				}
+				client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+				if err != nil {
+					return nil, nil, c.Errf("creating etcd client: %v", err)
+				}
+				if etcdClient != nil {
+					etcdClient.Close()
+				}
+				etcdClient = client
+				acmeConfig.Storage = etcd.New(client)
+			case "kubernetes":
+				if len(storageArgs) != 2 {
+					return nil, nil, c.ArgErr()
+				}
+				restConfig, err := rest.InClusterConfig()
+				if err != nil {
+					return nil, nil, c.Errf("creating kubernetes client: %v", err)
+				}
+				client, err := clientset.NewForConfig(restConfig)
+				if err != nil {
+					return nil, nil, c.Errf("creating kubernetes client: %v", err)
+				}
+				acmeConfig.Storage = kubernetes.New(client, storageArgs[1])
+			default:
+				return nil, nil, c.Errf("unknown storage type '%s'", storageArgs[0])
+			}
+		case "challenges":
+			challenges := c.RemainingArgs()
+			if len(challenges) == 0 {
+				return nil, nil, c.ArgErr()
+			}
+			for i, challenge := range challenges {
+				switch challenge {
+				case "dns-01", "http-01", "tls-alpn-01":
+				default:
+					return nil, nil, c.Errf("unknown challenge type '%s'", challenge)
+				}
+				if containsString(challenges[:i], challenge) {
+					return nil, nil, c.Errf("duplicate challenge type '%s'", challenge)
+				}
+			}
+			acmeConfig.Challenges = challenges
+		case "http_challenge_address":
+			addrArgs := c.RemainingArgs()
+			if len(addrArgs) != 1 {
+				return nil, nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(addrArgs[0]); err != nil {
+				return nil, nil, c.Errf("invalid http_challenge_address '%s': %v", addrArgs[0], err)
+			}
+			acmeConfig.HTTPChallengeAddr = addrArgs[0]
+		case "dns_provider":
+			provider, err := parseDNSProvider(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			acmeConfig.DNSProvider = provider
+		case "encryption_key":
+			keyArgs := c.RemainingArgs()
+			if len(keyArgs) != 2 {
+				return nil, nil, c.ArgErr()
+			}
+			key, err := loadEncryptionKey(keyArgs[0], keyArgs[1])
+			if err != nil {
+				return nil, nil, c.Errf("loading encryption key: %v", err)
+			}
+			encryptionKey = key
+		default:
+			return nil, nil, c.Errf("unknown option '%s'", c.Val())
+		}
+	}
+	if len(acmeConfig.Domains) == 0 {
+		return nil, nil, c.Err("missing domain for acme")
+	}
+	if (acmeConfig.EABKeyID == "") != (acmeConfig.EABHMACKey == "") {
+		return nil, nil, c.Err("eab_key_id and eab_hmac_key must be set together")
+	}
+	if encryptionKey != nil {
+		if acmeConfig.Storage == nil {
+			acmeConfig.Storage = acme.DefaultStorage()
+		}
+		storage, err := acme.NewEncryptedStorage(acmeConfig.Storage, encryptionKey)
+		if err != nil {
+			return nil, nil, c.Errf("loading encryption key: %v", err)
+		}
+		acmeConfig.Storage = storage
+	}
+
+	closeStorage = func() error { return nil }
+	if etcdClient != nil {
+		closeStorage = etcdClient.Close
+	}
+	return acmeConfig, closeStorage, nil
+}
+
+// dnsProviders create the providers of the dns_provider
+// directive from the options in its block.
+var dnsProviders = map[string]func(c *caddy.Controller, options map[string]string) (acme.DNSProvider, error){
+	"rfc2136": newRFC2136Provider,
+}
+
+// parseDNSProvider parses a "dns_provider NAME { OPTION VALUE... }" directive.
+// The options block is nested in the acme block, so it is read token by token.
+func parseDNSProvider(c *caddy.Controller) (acme.DNSProvider, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.ArgErr()
+	}
+	newProvider, ok := dnsProviders[args[0]]
+	if !ok {
+		return nil, c.Errf("unknown dns_provider '%s'", args[0])
+	}
+
+	options := make(map[string]string)
+	// RemainingArgs stops in front of the opening brace
+	if c.NextArg() {
+		for {
+			if !c.Next() {
+				return nil, c.EOFErr()
+			}
+			if c.Val() == "}" {
+				break
+			}
+			option := c.Val()
+			values := c.RemainingArgs()
+			if len(values) != 1 {
+				return nil, c.ArgErr()
+			}
+			if _, ok := options[option]; ok {
+				return nil, c.Errf("duplicate dns_provider option '%s'", option)
+			}
+			options[option] = values[0]
+		}
+	}
+	return newProvider(c, options)
+}
+
+// newRFC2136Provider returns a provider sending RFC 2136 dynamic updates.
+func newRFC2136Provider(c *caddy.Controller, options map[string]string) (acme.DNSProvider, error) {
+	p := &rfc2136.Provider{Timeout: 10 * time.Second}
+	for option, value := range options {
+		switch option {
+		case "server":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				value = net.JoinHostPort(value, "53")
+			}
+			p.Server = value
+		case "key_name":
+			p.KeyName = value
+		case "key_algorithm":
+			p.KeyAlgorithm = value
+		case "key":
+			if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+				return nil, c.Errf("invalid rfc2136 key: must be base64 encoded")
+			}
+			p.Key = value
+		default:
+			return nil, c.Errf("unknown rfc2136 option '%s'", option)
+		}
+	}
+	if p.Server == "" {
+		return nil, c.Err("missing rfc2136 server")
+	}
+	if (p.KeyName == "") != (p.Key == "") {
+		return nil, c.Err("rfc2136 key_name and key must be set together")
+	}
+	return p, nil
+}
+
+// loadEncryptionKey returns the base64 encoded storage encryption key
+// in the environment variable or file named by name.
+func loadEncryptionKey(source, name string) ([]byte, error) {
+	var encoded string
+	switch source {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		encoded = value
+	case "file":
+		value, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(value)
+	default:
+		return nil, fmt.Errorf("unknown key source '%s'", source)
+	}
+	return acme.ParseEncryptionKey(encoded)
+}
+
+// setupErr returns err of a request made with ctx during setup,
+// telling if it failed because the request took too long.
+func setupErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("no response from the storage or the CA within %s: %v", setupTimeout, err)
+	}
+	return err
+}
+
+// setupACME sets up the manager of the certificate configured by acmeConfig
+// and returns the TLS configuration serving it. closeStorage is called once
+// the manager is shut down.
+func setupACME(c *caddy.Controller, acmeConfig *acme.Config, closeStorage func() error) (*ctls.Config, error) {
+	// the plugin chain answers the dns-01 challenges
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return acme.ChallengeHandler{Next: next}
+	})
+
+	manager, err := acme.NewACMEManager(acmeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+
+	// entries stored before encryption was enabled
+	// are encrypted before anything else is stored
+	if storage, ok := acmeConfig.Storage.(*acme.EncryptedStorage); ok {
+		if err := storage.Migrate(ctx); err != nil {
+			return nil, setupErr(ctx, fmt.Errorf("encrypting storage: %v", err))
+		}
+	}
+	err = acme.StartACME(ctx, manager)
 	if err != nil {
-		return false, fmt.Errorf("could not parse TLS cert: %s", err.Error())
+		return nil, setupErr(ctx, err)
 	}
-	valid := parsedCert.NotAfter.After(time.Now())
 
-	return valid, nil
+	// the challenges are answered by the plugin chain, so the
+	// certificate can only be obtained once CoreDNS is serving;
+	// the manager keeps renewing it from then on. The renewal is
+	// stopped before a reload starts the one of the new instance,
+	// and started again if the reload fails.
+	c.OnStartup(func() error {
+		manager.SetLocalDNSAddr(localDNSAddr(c))
+		manager.Start()
+		return nil
+	})
+	c.OnRestart(func() error {
+		manager.Stop()
+		return nil
+	})
+	c.OnRestartFailed(func() error {
+		manager.Start()
+		return nil
+	})
+	// the storage is closed once the renewal is stopped, as
+	// it may still release a lock until then
+	c.OnShutdown(func() error {
+		manager.Stop()
+		return closeStorage()
+	})
+
+	// serve the certificate in storage right away, it is
+	// replaced once renewed without restarting CoreDNS
+	certPresent, err := manager.LoadCertificate(ctx)
+	if err != nil {
+		return nil, setupErr(ctx, err)
+	}
+	if certPresent {
+		log.Infof("Serving the stored certificate for %v", acmeConfig.Domains)
+	} else {
+		log.Infof("No valid certificate stored for %v, obtaining one once CoreDNS is serving", acmeConfig.Domains)
+	}
+	tlsconf := &ctls.Config{GetCertificate: manager.GetCertificate}
+	if containsString(acmeConfig.Challenges, "tls-alpn-01") {
+		tlsconf.GetConfigForClient = acme.GetConfigForClient
+	}
+	tls.SetTLSDefaults(tlsconf)
+	return tlsconf, nil
 }
 
 func parseTLS(c *caddy.Controller) error {
@@ -77,51 +527,20 @@ func parseTLS(c *caddy.Controller) error {
 		args := c.RemainingArgs()
 		fmt.Printf("remaining args: %s \n", args)
 
-		if args[0] == "acme" {
+		if len(args) > 0 && args[0] == "acme" {
 			// start of the acme flow,
-			// first check if a certificate is already present
+			// first read the acme configuration block
 			fmt.Println("Starting ACME")
-			certPresent := false
-			//certValid := false
-			certPresent, err := acmeCertPresent()
+			acmeConfig, closeStorage, err := parseACMEConfig(c)
 			if err != nil {
 				return err
 			}
-			if certPresent {
-				// TODO: check if the certificate is valid
-				fmt.Println("Loading existing certificate")
-				tlsconf, err = tls.NewTLSConfig(acmeCertFile, acmeKeyFile, "")
-				if err != nil {
-					return err
-				}
-
-				configureTLS(config, tlsconf, clientAuth)
-				return nil
-
-			}
-			fmt.Println("No valid Certificate found, creating a new one")
-			var domainNameACME string
-			for c.NextBlock() {
-				fmt.Println("ACME Config Block Found")
-				switch c.Val() {
-				case "domain":
-					fmt.Println("Found Keyword Domain")
-					domainArgs := c.RemainingArgs()
-					if len(domainArgs) > 1 {
-						return plugin.Error("tls", c.Errf("To many arguments to domain"))
-					}
-					domainNameACME = domainArgs[0]
-					fmt.Println(domainNameACME)
-				}
-			}
-			config := dnsserver.GetConfig(c)
-			tlsconf, err = acme.StartACME(config, domainNameACME)
+			tlsconf, err = setupACME(c, acmeConfig, closeStorage)
 			if err != nil {
-				fmt.Println("Error during TLS Config with ACME")
-				fmt.Println(err)
+				// a failed setup is discarded without being shut down
+				closeStorage()
+				return err
 			}
-			tlsconf, err = tls.NewTLSConfig(acmeCertFile, acmeKeyFile, "")
-			fmt.Println("Certificate aleady there")
 		} else {
 			fmt.Println("Uing manually conigured certificate")
 			if len(args) < 2 || len(args) > 3 {
@@ -156,6 +575,15 @@ func parseTLS(c *caddy.Controller) error {
 			if err != nil {
 				return err
 			}
+
+			// serve the certificate files from a cache, so that
+			// they are loaded again once they change on disk
+			cache, err := acme.NewFileCertCache(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			tlsconf.Certificates = nil
+			tlsconf.GetCertificate = cache.GetCertificate
 		}
 	}
 	configureTLS(config, tlsconf, clientAuth)
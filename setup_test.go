@@ -2,11 +2,16 @@ package tlsplus
 
 import (
 	"crypto/tls"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/mariuskimmina/tlsplus/dnsprovider/rfc2136"
 )
 
 func TestTLS(t *testing.T) {
@@ -84,5 +89,213 @@ func TestTLSClientAuthentication(t *testing.T) {
 		if cfg.TLSConfig.ClientAuth != test.expectedType {
 			t.Errorf("Test %d: Unexpected client auth type: %d", i, cfg.TLSConfig.ClientAuth)
 		}
+		if cfg.TLSConfig.GetCertificate == nil || len(cfg.TLSConfig.Certificates) != 0 {
+			t.Errorf("Test %d: Expected certificate to be served by GetCertificate", i)
+		}
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	t.Setenv("TLS_TEST_ENCRYPTION_KEY", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+	t.Setenv("TLS_TEST_SHORT_ENCRYPTION_KEY", "c2VjcmV0")
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedCA         string   // expected ACME directory. Empty for negative cases.
+		expectedDomains    []string // expected domains. Nil to skip the check.
+		expectedErrContent string   // substring from the expected error. Empty for positive cases.
+	}{
+		// positive
+		{"tls acme {\ndomain example.com\n}", false, acme.DefaultCA, []string{"example.com"}, ""},
+		{"tls acme {\ndomain example.com\nca letsencrypt\n}", false, acme.LetsEncryptProductionCA, nil, ""},
+		{"tls acme {\ndomain example.com\nca letsencrypt-staging\n}", false, acme.LetsEncryptStagingCA, nil, ""},
+		{"tls acme {\ndomain example.com\nca zerossl\n}", false, acme.ZeroSSLProductionCA, nil, ""},
+		{"tls acme {\ndomain example.com\nca https://pebble:14000/dir\n}", false, "https://pebble:14000/dir", nil, ""},
+		{"tls acme {\ndomain example.com\nca_root test_ca.pem\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nemail admin@example.com\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nagree_tos\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nca zerossl\neab_key_id kid-1\neab_hmac_key c2VjcmV0\n}", false, acme.ZeroSSLProductionCA, nil, ""},
+		{"tls acme {\ndomain example.com\ninsecure_skip_verify\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\npropagation_timeout 5m\npropagation_check_nameservers\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain dns.example.com dot.example.com\ndomain doh.example.com\n}", false, acme.DefaultCA, []string{"dns.example.com", "dot.example.com", "doh.example.com"}, ""},
+		{"tls acme {\ndomain Example.com. example.com\n}", false, acme.DefaultCA, []string{"example.com"}, ""},
+		{"tls acme {\ndomain *.example.com example.com\n}", false, acme.DefaultCA, []string{"*.example.com", "example.com"}, ""},
+		{"tls acme {\ndomain example.com\nstorage file /var/lib/coredns\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nchallenges tls-alpn-01\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nchallenges tls-alpn-01 dns-01\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nchallenges http-01 dns-01\nhttp_challenge_address 127.0.0.1:8080\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nstorage memory\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\n}\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndns_provider rfc2136 {\nserver 192.0.2.1:5353\nkey_name acme.\nkey_algorithm hmac-sha512.\nkey c2VjcmV0\n}\ndomain example.com\n}", false, acme.DefaultCA, []string{"example.com"}, ""},
+		{"tls acme {\ndomain example.com\nstorage etcd\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nstorage etcd http://etcd-1:2379 http://etcd-2:2379\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nencryption_key file test_encryption.key\n}", false, acme.DefaultCA, nil, ""},
+		{"tls acme {\ndomain example.com\nencryption_key env TLS_TEST_ENCRYPTION_KEY\nstorage file /var/lib/coredns\n}", false, acme.DefaultCA, nil, ""},
+		// negative
+		{"tls acme {\n}", true, "", nil, "missing domain"},
+		{"tls acme {\ndomain\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com ..\n}", true, "", nil, "invalid domain"},
+		{"tls acme {\ndomain dns..example.com\n}", true, "", nil, "invalid domain"},
+		{"tls acme {\ndomain *.*.example.com\n}", true, "", nil, "invalid wildcard"},
+		{"tls acme {\ndomain dns.*.example.com\n}", true, "", nil, "invalid wildcard"},
+		{"tls acme {\ndomain *.com\n}", true, "", nil, "invalid wildcard"},
+		{"tls acme {\ndomain example.com\nunknown\n}", true, "", nil, "unknown option"},
+		{"tls acme {\ndomain example.com\nca\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nca bogus\n}", true, "", nil, "invalid CA"},
+		{"tls acme {\ndomain example.com\nca http://pebble:14000/dir\n}", true, "", nil, "invalid CA"},
+		{"tls acme {\ndomain example.com\nca_root\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nemail\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nagree_tos yes\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\neab_key_id kid-1\n}", true, "", nil, "must be set together"},
+		{"tls acme {\ndomain example.com\neab_hmac_key c2VjcmV0\n}", true, "", nil, "must be set together"},
+		{"tls acme {\ndomain example.com\neab_key_id kid-1\neab_hmac_key not/base64url=\n}", true, "", nil, "base64url"},
+		{"tls acme {\ndomain example.com\nca_root missing_ca.pem\n}", true, "", nil, "error reading"},
+		{"tls acme {\ndomain example.com\ninsecure_skip_verify yes\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\npropagation_timeout\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\npropagation_timeout soon\n}", true, "", nil, "invalid propagation_timeout"},
+		{"tls acme {\ndomain example.com\npropagation_timeout -1s\n}", true, "", nil, "invalid propagation_timeout"},
+		{"tls acme {\ndomain example.com\npropagation_check_nameservers yes\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nchallenges\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nchallenges dns-02\n}", true, "", nil, "unknown challenge type"},
+		{"tls acme {\ndomain example.com\nchallenges dns-01 tls-alpn-01 dns-01\n}", true, "", nil, "duplicate challenge type"},
+		{"tls acme {\ndomain example.com\nhttp_challenge_address\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nhttp_challenge_address 80\n}", true, "", nil, "invalid http_challenge_address"},
+		{"tls acme {\ndomain example.com\ndns_provider\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\ndns_provider bogus {\nserver 192.0.2.1\n}\n}", true, "", nil, "unknown dns_provider"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nkey_name acme.\nkey c2VjcmV0\n}\n}", true, "", nil, "missing rfc2136 server"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136\n}", true, "", nil, "missing rfc2136 server"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\nbogus value\n}\n}", true, "", nil, "unknown rfc2136 option"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\nserver 192.0.2.2\n}\n}", true, "", nil, "duplicate dns_provider option"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver\n}\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\nkey_name acme.\n}\n}", true, "", nil, "must be set together"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\nkey_name acme.\nkey !secret\n}\n}", true, "", nil, "base64"},
+		{"tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\n", true, "", nil, "Unexpected EOF"},
+		{"tls acme {\ndomain example.com\nstorage\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nstorage file\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nstorage file /a /b\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nstorage memory /a\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nstorage bogus /a\n}", true, "", nil, "unknown storage type"},
+		{"tls acme {\ndomain example.com\nstorage kubernetes\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nstorage kubernetes kube-system extra\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nencryption_key\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nencryption_key file\n}", true, "", nil, "Wrong argument"},
+		{"tls acme {\ndomain example.com\nencryption_key bogus KEY\n}", true, "", nil, "unknown key source"},
+		{"tls acme {\ndomain example.com\nencryption_key file missing.key\n}", true, "", nil, "no such file"},
+		{"tls acme {\ndomain example.com\nencryption_key env TLS_TEST_MISSING_ENCRYPTION_KEY\n}", true, "", nil, "is not set"},
+		{"tls acme {\ndomain example.com\nencryption_key env TLS_TEST_SHORT_ENCRYPTION_KEY\n}", true, "", nil, "must be 32 bytes"},
+		{"tls acme {\ndomain example.com\nencryption_key file test_ca.pem\n}", true, "", nil, "base64"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.Next()
+		c.RemainingArgs()
+		cfg, closeStorage, err := parseACMEConfig(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+
+		if cfg.CA != test.expectedCA {
+			t.Errorf("Test %d: Expected CA %s, found %s", i, test.expectedCA, cfg.CA)
+		}
+		if test.expectedDomains != nil && !reflect.DeepEqual(cfg.Domains, test.expectedDomains) {
+			t.Errorf("Test %d: Expected domains %v, found %v", i, test.expectedDomains, cfg.Domains)
+		}
+		if err := closeStorage(); err != nil {
+			t.Errorf("Test %d: Failed to close storage: %v", i, err)
+		}
+	}
+}
+
+func TestDNSProviderConfig(t *testing.T) {
+	input := "tls acme {\ndomain example.com\ndns_provider rfc2136 {\nserver 192.0.2.1\nkey_name acme.\nkey c2VjcmV0\n}\nemail admin@example.com\n}"
+	c := caddy.NewTestController("dns", input)
+	c.Next()
+	c.RemainingArgs()
+	cfg, closeStorage, err := parseACMEConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer closeStorage()
+
+	expected := &rfc2136.Provider{
+		Server:  "192.0.2.1:53",
+		KeyName: "acme.",
+		Key:     "c2VjcmV0",
+		Timeout: 10 * time.Second,
+	}
+	if !reflect.DeepEqual(cfg.DNSProvider, expected) {
+		t.Errorf("Expected provider %+v, got %+v", expected, cfg.DNSProvider)
+	}
+	if cfg.Email != "admin@example.com" {
+		t.Errorf("Expected the options after the dns_provider block to be parsed, got email %q", cfg.Email)
+	}
+}
+
+func TestLocalDNSAddr(t *testing.T) {
+	tests := []struct {
+		keys     []string
+		hosts    []string // the addresses set by bind
+		expected string
+	}{
+		{[]string{"tls://.:853"}, nil, "127.0.0.1:53"},
+		{[]string{"tls://.:853", "dns://.:1053"}, nil, "127.0.0.1:1053"},
+		{[]string{"dns://example.com:53"}, nil, "127.0.0.1:53"},
+		{[]string{"dns://.:53"}, []string{""}, "127.0.0.1:53"},
+		{[]string{"dns://.:53"}, []string{"192.0.2.1"}, "192.0.2.1:53"},
+		{[]string{"dns://.:53"}, []string{"192.0.2.1", "127.0.0.1"}, "127.0.0.1:53"},
+		{[]string{"dns://.:1053"}, []string{"2001:db8::1"}, "[2001:db8::1]:1053"},
+		{[]string{"dns://.:53"}, []string{"0.0.0.0"}, "127.0.0.1:53"},
+		{[]string{"dns://.:53"}, []string{"::"}, "[::1]:53"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", "tls acme")
+		c.ServerBlockKeys = test.keys
+		if test.hosts != nil {
+			dnsserver.GetConfig(c).ListenHosts = test.hosts
+		}
+		if addr := localDNSAddr(c); addr != test.expected {
+			t.Errorf("Test %d: Expected address %s, got %s", i, test.expected, addr)
+		}
+	}
+}
+
+func TestACMESetupTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { setupTimeout = timeout }(setupTimeout)
+	setupTimeout = time.Second
+
+	before := runtime.NumGoroutine()
+
+	// nothing listens on the port of the etcd endpoint
+	c := caddy.NewTestController("dns", "tls acme {\ndomain example.com\nstorage etcd http://127.0.0.1:1\n}")
+	start := time.Now()
+	err := setup(c)
+	if err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("Expected setup to fail with an unreachable storage, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected setup to give up after %s, took %s", setupTimeout, elapsed)
+	}
+
+	// the failed setup is not shut down, the etcd client is closed right away
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the etcd client to be closed, %d goroutines left of %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
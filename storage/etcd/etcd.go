@@ -0,0 +1,253 @@
+// Package etcd implements acme.Storage on top of etcd, so that several
+// CoreDNS instances share their accounts and certificates.
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mariuskimmina/tlsplus/acme"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// DefaultPrefix is the etcd key prefix everything is stored under.
+const DefaultPrefix = "/coredns/tls"
+
+// DefaultLockTTL is how long a lock outlives its holder if
+// the holder dies without releasing it.
+const DefaultLockTTL = 30 * time.Second
+
+// Storage stores keys in etcd. The value of a key is stored under
+// Prefix/data/key and its metadata under Prefix/meta/key, locks are
+// held under Prefix/locks/key and bound to a lease, so that they are
+// released once their holder stops keeping the lease alive.
+type Storage struct {
+	Client  *clientv3.Client
+	Prefix  string
+	LockTTL time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*lock
+}
+
+// lock is a lock held by Storage.
+type lock struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+// keyMeta is stored along with each value.
+type keyMeta struct {
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+// New returns a Storage that uses client with the default prefix and lock TTL.
+func New(client *clientv3.Client) *Storage {
+	return &Storage{
+		Client:  client,
+		Prefix:  DefaultPrefix,
+		LockTTL: DefaultLockTTL,
+	}
+}
+
+// Store saves value at key.
+func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
+	meta, err := json.Marshal(keyMeta{Modified: time.Now(), Size: int64(len(value))})
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.Txn(ctx).Then(
+		clientv3.OpPut(s.dataKey(key), string(value)),
+		clientv3.OpPut(s.metaKey(key), string(meta)),
+	).Commit()
+	return err
+}
+
+// Load retrieves the value at key.
+func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.Client.Get(ctx, s.dataKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, notExist("load", key)
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Delete deletes the value at key.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.Txn(ctx).Then(
+		clientv3.OpDelete(s.dataKey(key)),
+		clientv3.OpDelete(s.metaKey(key)),
+	).Commit()
+	return err
+}
+
+// Exists returns true if key exists, either as a value
+// or as the prefix of other keys.
+func (s *Storage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys that match prefix. Like directories, the
+// prefixes of keys are listed as well.
+func (s *Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	prefix = strings.Trim(prefix, "/")
+	resp, err := s.Client.Get(ctx, s.dirKey(prefix), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, notExist("list", prefix)
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, kv := range resp.Kvs {
+		rel := strings.TrimPrefix(string(kv.Key), s.dirKey(prefix))
+		parts := strings.Split(rel, "/")
+		if !recursive {
+			parts = parts[:1]
+		}
+		for i := range parts {
+			key := path.Join(prefix, path.Join(parts[:i+1]...))
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (s *Storage) Stat(ctx context.Context, key string) (acme.KeyInfo, error) {
+	resp, err := s.Client.Get(ctx, s.metaKey(key))
+	if err != nil {
+		return acme.KeyInfo{}, err
+	}
+	if len(resp.Kvs) > 0 {
+		var meta keyMeta
+		if err := json.Unmarshal(resp.Kvs[0].Value, &meta); err != nil {
+			return acme.KeyInfo{}, fmt.Errorf("decoding metadata of %s: %v", key, err)
+		}
+		return acme.KeyInfo{Key: key, Modified: meta.Modified, Size: meta.Size, IsTerminal: true}, nil
+	}
+
+	// key may be the prefix of other keys
+	resp, err = s.Client.Get(ctx, s.dirKey(key), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return acme.KeyInfo{}, err
+	}
+	if resp.Count == 0 {
+		return acme.KeyInfo{}, notExist("stat", key)
+	}
+	return acme.KeyInfo{Key: key, IsTerminal: false}, nil
+}
+
+// Lock obtains the lock for key, waiting until it is released by its
+// holder or until ctx is done. The lock is bound to a lease that is
+// kept alive until Unlock, and expires after LockTTL otherwise.
+func (s *Storage) Lock(ctx context.Context, key string) error {
+	ttl := int(s.LockTTL / time.Second)
+	if ttl <= 0 {
+		ttl = int(DefaultLockTTL / time.Second)
+	}
+	// the lease is granted with ctx, but kept alive
+	// until Unlock, even once ctx is done
+	lease, err := s.Client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return fmt.Errorf("creating lease: %v", err)
+	}
+	session, err := concurrency.NewSession(s.Client, concurrency.WithLease(lease.ID), concurrency.WithContext(context.Background()))
+	if err != nil {
+		return fmt.Errorf("creating lease: %v", err)
+	}
+	mutex := concurrency.NewMutex(session, s.lockKey(key))
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks == nil {
+		s.locks = make(map[string]*lock)
+	}
+	s.locks[key] = &lock{session: session, mutex: mutex}
+	return nil
+}
+
+// Unlock releases the lock for key.
+func (s *Storage) Unlock(ctx context.Context, key string) error {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	delete(s.locks, key)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", key)
+	}
+
+	err := l.mutex.Unlock(ctx)
+	// revoking the lease releases the lock even if unlocking failed
+	if closeErr := l.session.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Storage) String() string {
+	return "etcd:" + s.prefix()
+}
+
+func (s *Storage) prefix() string {
+	if s.Prefix == "" {
+		return DefaultPrefix
+	}
+	return strings.TrimSuffix(s.Prefix, "/")
+}
+
+func (s *Storage) dataKey(key string) string {
+	return s.prefix() + "/data/" + strings.Trim(key, "/")
+}
+
+// dirKey returns the prefix of the data keys below key,
+// which are all data keys if key is empty.
+func (s *Storage) dirKey(key string) string {
+	if strings.Trim(key, "/") == "" {
+		return s.prefix() + "/data/"
+	}
+	return s.dataKey(key) + "/"
+}
+
+func (s *Storage) metaKey(key string) string {
+	return s.prefix() + "/meta/" + strings.Trim(key, "/")
+}
+
+// lockKey returns the prefix of the lock for key. The key is escaped, so
+// that the lock of a key does not contain the locks of keys below it.
+func (s *Storage) lockKey(key string) string {
+	return s.prefix() + "/locks/" + url.QueryEscape(strings.Trim(key, "/"))
+}
+
+// notExist returns an error for the operation op on key
+// that satisfies errors.Is(err, fs.ErrNotExist).
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+// Interface guard
+var _ acme.Storage = (*Storage)(nil)
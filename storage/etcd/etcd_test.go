@@ -0,0 +1,282 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/mariuskimmina/tlsplus/acme/storagetest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// endpoint is the client URL of the embedded etcd server the tests run against.
+var endpoint string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "etcd")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	e, err := startEtcd(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		fmt.Fprintln(os.Stderr, "Failed to start embedded etcd:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startEtcd starts a single member etcd server with its data in dir.
+func startEtcd(dir string) (*embed.Etcd, error) {
+	clientURL, err := freeURL()
+	if err != nil {
+		return nil, err
+	}
+	peerURL, err := freeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		return nil, fmt.Errorf("etcd not ready in time")
+	}
+	endpoint = clientURL.String()
+	return e, nil
+}
+
+// freeURL returns an http URL on a free local port.
+func freeURL() (*url.URL, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	return url.Parse("http://" + ln.Addr().String())
+}
+
+// newTestStorage returns a Storage with its own client, under a prefix unique to the test.
+// The prefix is deleted once the test finished, so that the test can run again against
+// the same etcd server.
+func newTestStorage(t *testing.T) *Storage {
+	prefix := "/test/" + t.Name()
+	// the test may close the client of the storage it got
+	cleanup := newTestStorageWithPrefix(t, prefix)
+	t.Cleanup(func() {
+		if _, err := cleanup.Client.Delete(context.Background(), prefix+"/", clientv3.WithPrefix()); err != nil {
+			t.Errorf("Failed to delete %s: %s", prefix, err)
+		}
+	})
+	return newTestStorageWithPrefix(t, prefix)
+}
+
+// newTestStorageWithPrefix returns a Storage with its own client under prefix.
+func newTestStorageWithPrefix(t *testing.T, prefix string) *Storage {
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create etcd client: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	s := New(client)
+	s.Prefix = prefix
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	if _, err := s.Load(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for missing key, got: %v", err)
+	}
+
+	for _, key := range []string{"acme/ca/users/default/account.key", "certificates/ca/example.com/example.com.crt", "certificates/ca/example.com/example.com.key"} {
+		if err := s.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Failed to store %s: %s", key, err)
+		}
+	}
+	value, err := s.Load(ctx, "certificates/ca/example.com/example.com.crt")
+	if err != nil || string(value) != "certificates/ca/example.com/example.com.crt" {
+		t.Errorf("Expected stored value, got %q: %v", value, err)
+	}
+
+	if !s.Exists(ctx, "certificates/ca/example.com") {
+		t.Errorf("Expected prefix of stored keys to exist")
+	}
+	info, err := s.Stat(ctx, "certificates/ca/example.com/example.com.key")
+	if err != nil || !info.IsTerminal || info.Size != int64(len("certificates/ca/example.com/example.com.key")) || info.Modified.IsZero() {
+		t.Errorf("Unexpected key info %+v: %v", info, err)
+	}
+	info, err = s.Stat(ctx, "certificates/ca")
+	if err != nil || info.IsTerminal {
+		t.Errorf("Expected non-terminal key info, got %+v: %v", info, err)
+	}
+
+	keys, err := s.List(ctx, "certificates", false)
+	if err != nil || !reflect.DeepEqual(keys, []string{"certificates/ca"}) {
+		t.Errorf("Unexpected keys %v: %v", keys, err)
+	}
+	keys, err = s.List(ctx, "certificates", true)
+	expected := []string{
+		"certificates/ca",
+		"certificates/ca/example.com",
+		"certificates/ca/example.com/example.com.crt",
+		"certificates/ca/example.com/example.com.key",
+	}
+	if err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v: %v", expected, keys, err)
+	}
+
+	if err := s.Delete(ctx, "certificates/ca/example.com/example.com.crt"); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if s.Exists(ctx, "certificates/ca/example.com/example.com.crt") {
+		t.Errorf("Expected deleted key not to exist")
+	}
+}
+
+func TestStorageConformance(t *testing.T) {
+	s := newTestStorage(t)
+	storagetest.Test(t, s, func() acme.Storage {
+		return newTestStorageWithPrefix(t, s.Prefix)
+	})
+}
+
+func TestStorageLockReplicas(t *testing.T) {
+	ctx := context.Background()
+	const replicas, iterations = 10, 5
+
+	var inside int32
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		// every replica has its own client and lease
+		s := newTestStorageWithPrefix(t, "/test/"+t.Name())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := s.Lock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to lock: %s", err)
+					return
+				}
+				if n := atomic.AddInt32(&inside, 1); n != 1 {
+					t.Errorf("Expected only one holder of the lock, got %d", n)
+				}
+				counter++
+				atomic.AddInt32(&inside, -1)
+				if err := s.Unlock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to unlock: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != replicas*iterations {
+		t.Errorf("Expected counter %d, got %d", replicas*iterations, counter)
+	}
+}
+
+func TestStorageLockContext(t *testing.T) {
+	holder, waiter := newTestStorage(t), newTestStorage(t)
+	if err := holder.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+
+	// the locks of keys below key are separate
+	if err := waiter.Lock(context.Background(), "key/below"); err != nil {
+		t.Fatalf("Failed to lock key below: %s", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key/below"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := waiter.Lock(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected waiting for the lock to be cancelled, got: %v", err)
+	}
+
+	if err := holder.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+	if err := waiter.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock released lock: %s", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+}
+
+func TestStorageLockUnreachable(t *testing.T) {
+	// nothing listens on the port of the endpoint
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{"http://127.0.0.1:1"}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create etcd client: %s", err)
+	}
+	defer client.Close()
+	s := New(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Lock(ctx, "key") }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected locking to fail without etcd")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected locking to give up once the context is done")
+	}
+}
+
+func TestStorageLockExpires(t *testing.T) {
+	holder, waiter := newTestStorage(t), newTestStorage(t)
+	holder.LockTTL = 2 * time.Second
+	if err := holder.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+
+	// the holder dies without unlocking, so its lease is no longer kept alive
+	holder.Client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := waiter.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Expected lock to expire with the lease of its holder, got: %s", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+}
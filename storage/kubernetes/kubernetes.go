@@ -0,0 +1,611 @@
+// Package kubernetes implements acme.Storage on top of Kubernetes Secrets,
+// so that accounts and certificates survive restarts of CoreDNS pods and
+// are shared between replicas.
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mariuskimmina/tlsplus/acme"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+var log = clog.NewWithPlugin("tls")
+
+const (
+	// DefaultLeaseDuration is how long a lock outlives its holder
+	// if the holder dies without releasing it.
+	DefaultLeaseDuration = 30 * time.Second
+
+	// defaultLockPollInterval is how often a held lock is
+	// checked for being released.
+	defaultLockPollInterval = time.Second
+
+	// managedByLabel marks the Secrets and Leases of the storage.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "coredns-tls"
+
+	// keyAnnotation holds the storage key of the directory a Secret holds.
+	keyAnnotation = "tls.coredns.io/key"
+
+	// modifiedAnnotationPrefix prefixes the annotations that hold
+	// the modification time of each data entry of a Secret.
+	modifiedAnnotationPrefix = "modified.tls.coredns.io/"
+
+	// certificatesPrefix is the storage prefix of certificates,
+	// which are stored in kubernetes.io/tls Secrets.
+	certificatesPrefix = "certificates/"
+)
+
+// validFile matches the names of files, which are used as data keys of Secrets.
+var validFile = regexp.MustCompile(`^[a-zA-Z0-9]([-._a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// Storage stores keys in Secrets of a namespace. Every directory of keys
+// is a Secret, with one data entry per file. The directory of a certificate
+// is a kubernetes.io/tls Secret, its <name>.crt and <name>.key files are
+// the tls.crt and tls.key entries, so that it can be used by other workloads.
+// Locks are coordination.k8s.io Leases, renewed as long as they are held.
+type Storage struct {
+	Client    clientset.Interface
+	Namespace string
+
+	// Identity is the holder identity of the Leases of this
+	// Storage. It must be unique among all instances.
+	Identity string
+
+	LeaseDuration time.Duration
+
+	// lockPollInterval is how often a held lock is checked.
+	lockPollInterval time.Duration
+
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// New returns a Storage for the Secrets in namespace with a unique identity.
+func New(client clientset.Interface, namespace string) *Storage {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Storage{
+		Client:           client,
+		Namespace:        namespace,
+		Identity:         hostname + "-" + hex.EncodeToString(suffix),
+		LeaseDuration:    DefaultLeaseDuration,
+		lockPollInterval: defaultLockPollInterval,
+	}
+}
+
+// Store saves value at key.
+func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
+	dir, file, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	secrets := s.Client.CoreV1().Secrets(s.Namespace)
+	return retryOnConflict(func() error {
+		secret, err := secrets.Get(ctx, secretName(dir), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			secret = newSecret(dir)
+			setFile(secret, dir, file, value)
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		setFile(secret, dir, file, value)
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Load retrieves the value at key.
+func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	dir, file, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(ctx, secretName(dir), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, notExist("load", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := getFile(secret, dir, file)
+	if !ok {
+		return nil, notExist("load", key)
+	}
+	return value, nil
+}
+
+// Delete deletes the value at key. The Secret of its
+// directory is deleted along with its last file.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	dir, file, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	secrets := s.Client.CoreV1().Secrets(s.Namespace)
+	return retryOnConflict(func() error {
+		secret, err := secrets.Get(ctx, secretName(dir), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := getFile(secret, dir, file); !ok {
+			return nil
+		}
+		removeFile(secret, dir, file)
+		if len(files(secret)) == 0 {
+			err = secrets.Delete(ctx, secret.Name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &secret.ResourceVersion},
+			})
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Exists returns true if key exists, either as a file or as a directory.
+func (s *Storage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys that match prefix. Like with
+// FileStorage, directories are listed as well.
+func (s *Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	prefix = strings.Trim(prefix, "/")
+	all, err := s.allKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, key := range all {
+		if !strings.HasPrefix(key, prefix+"/") && prefix != "" {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+		parts := strings.Split(rel, "/")
+		if !recursive {
+			parts = parts[:1]
+		}
+		for i := range parts {
+			key := path.Join(prefix, path.Join(parts[:i+1]...))
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, notExist("list", prefix)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (s *Storage) Stat(ctx context.Context, key string) (acme.KeyInfo, error) {
+	dir, file, err := splitKey(key)
+	if err != nil {
+		return acme.KeyInfo{}, err
+	}
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(ctx, secretName(dir), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return acme.KeyInfo{}, err
+	}
+	if err == nil {
+		if value, ok := getFile(secret, dir, file); ok {
+			modified, _ := time.Parse(time.RFC3339Nano, secret.Annotations[modifiedAnnotationPrefix+dataKey(dir, file)])
+			return acme.KeyInfo{
+				Key:        key,
+				Modified:   modified,
+				Size:       int64(len(value)),
+				IsTerminal: true,
+			}, nil
+		}
+	}
+
+	// key may be a directory
+	all, err := s.allKeys(ctx)
+	if err != nil {
+		return acme.KeyInfo{}, err
+	}
+	key = strings.Trim(key, "/")
+	for _, k := range all {
+		if strings.HasPrefix(k, key+"/") {
+			return acme.KeyInfo{Key: key, IsTerminal: false}, nil
+		}
+	}
+	return acme.KeyInfo{}, notExist("stat", key)
+}
+
+// allKeys returns the keys of all files in storage.
+func (s *Storage) allKeys(ctx context.Context) ([]string, error) {
+	list, err := s.Client.CoreV1().Secrets(s.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for i := range list.Items {
+		secret := &list.Items[i]
+		dir, ok := secret.Annotations[keyAnnotation]
+		if !ok {
+			continue
+		}
+		for _, file := range files(secret) {
+			keys = append(keys, path.Join(dir, file))
+		}
+	}
+	return keys, nil
+}
+
+// Lock obtains the lock for key, waiting until it is released by its holder,
+// the Lease of its holder expires or ctx is done. The Lease is renewed until
+// Unlock, and expires after LeaseDuration otherwise.
+func (s *Storage) Lock(ctx context.Context, key string) error {
+	name := leaseName(key)
+	for {
+		acquired, err := s.tryAcquire(ctx, name)
+		if err != nil {
+			return fmt.Errorf("acquiring lease %s: %v", name, err)
+		}
+		if acquired {
+			s.keepLeaseRenewed(name)
+			return nil
+		}
+
+		select {
+		case <-time.After(s.pollInterval()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases the lock for key.
+func (s *Storage) Unlock(ctx context.Context, key string) error {
+	name := leaseName(key)
+	s.mu.Lock()
+	if done, ok := s.locks[name]; ok {
+		close(done)
+		delete(s.locks, name)
+	}
+	s.mu.Unlock()
+
+	leases := s.Client.CoordinationV1().Leases(s.Namespace)
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !s.holds(lease) {
+		return fmt.Errorf("lease %s is held by %s", name, holder(lease))
+	}
+	err = leases.Delete(ctx, name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// tryAcquire creates the Lease name, or takes it over if it expired.
+func (s *Storage) tryAcquire(ctx context.Context, name string) (bool, error) {
+	leases := s.Client.CoordinationV1().Leases(s.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(s.leaseDuration() / time.Second)
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{managedByLabel: managedBy},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.Identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if !leaseExpired(lease, now.Time) {
+		return false, nil
+	}
+
+	log.Infof("Lease %s of %s expired, taking it over", name, holder(lease))
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions += *lease.Spec.LeaseTransitions
+	}
+	lease.Spec.HolderIdentity = &s.Identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = &transitions
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		// someone else took it over first
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// keepLeaseRenewed renews the Lease name in the background until it is unlocked.
+func (s *Storage) keepLeaseRenewed(name string) {
+	done := make(chan struct{})
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]chan struct{})
+	}
+	s.locks[name] = done
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(s.leaseDuration() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.renew(name); err != nil {
+					log.Errorf("Renewing lease %s: %v", name, err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// renew updates the renew time of the Lease name.
+func (s *Storage) renew(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.leaseDuration()/3)
+	defer cancel()
+	leases := s.Client.CoordinationV1().Leases(s.Namespace)
+	return retryOnConflict(func() error {
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !s.holds(lease) {
+			return fmt.Errorf("lease was taken over by %s", holder(lease))
+		}
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.RenewTime = &now
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s *Storage) holds(lease *coordinationv1.Lease) bool {
+	return holder(lease) == s.Identity
+}
+
+func (s *Storage) leaseDuration() time.Duration {
+	if s.LeaseDuration < time.Second {
+		return DefaultLeaseDuration
+	}
+	return s.LeaseDuration
+}
+
+func (s *Storage) pollInterval() time.Duration {
+	if s.lockPollInterval <= 0 {
+		return defaultLockPollInterval
+	}
+	return s.lockPollInterval
+}
+
+func (s *Storage) String() string {
+	return "kubernetes:" + s.Namespace
+}
+
+// holder returns the holder identity of lease.
+func holder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// leaseExpired returns true if lease has no holder or has
+// not been renewed within its duration.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if holder(lease) == "" || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
+
+// splitKey returns the directory and file name of key.
+func splitKey(key string) (dir, file string, err error) {
+	key = strings.Trim(key, "/")
+	dir, file = path.Split(key)
+	if !validFile.MatchString(file) {
+		return "", "", fmt.Errorf("invalid key %q: %q is not a valid Secret data key", key, file)
+	}
+	return strings.TrimSuffix(dir, "/"), file, nil
+}
+
+// resourceName returns a valid, unique object name for str.
+func resourceName(prefix, str string) string {
+	sum := sha256.Sum256([]byte(str))
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(str))
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	if name != "" {
+		name += "-"
+	}
+	return prefix + name + hex.EncodeToString(sum[:5])
+}
+
+// secretName returns the name of the Secret for dir.
+func secretName(dir string) string {
+	return resourceName("coredns-tls-", dir)
+}
+
+// leaseName returns the name of the Lease for the lock of key.
+func leaseName(key string) string {
+	return resourceName("coredns-tls-lock-", strings.Trim(key, "/"))
+}
+
+// isTLS returns true if the Secret for dir is a kubernetes.io/tls Secret.
+func isTLS(dir string) bool {
+	return strings.HasPrefix(dir+"/", certificatesPrefix) && dir+"/" != certificatesPrefix
+}
+
+// dataKey returns the data key of file in the Secret for dir.
+func dataKey(dir, file string) string {
+	if isTLS(dir) {
+		switch file {
+		case path.Base(dir) + ".crt":
+			return corev1.TLSCertKey
+		case path.Base(dir) + ".key":
+			return corev1.TLSPrivateKeyKey
+		}
+	}
+	return file
+}
+
+// fileName returns the file of the data key in the Secret for dir.
+func fileName(dir, key string) string {
+	if isTLS(dir) {
+		switch key {
+		case corev1.TLSCertKey:
+			return path.Base(dir) + ".crt"
+		case corev1.TLSPrivateKeyKey:
+			return path.Base(dir) + ".key"
+		}
+	}
+	return key
+}
+
+// newSecret returns an empty Secret for dir.
+func newSecret(dir string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName(dir),
+			Labels:      map[string]string{managedByLabel: managedBy},
+			Annotations: map[string]string{keyAnnotation: dir},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: make(map[string][]byte),
+	}
+	if isTLS(dir) {
+		// a kubernetes.io/tls Secret must always have both
+		// entries, an empty one is a file that does not exist
+		secret.Type = corev1.SecretTypeTLS
+		secret.Data[corev1.TLSCertKey] = []byte{}
+		secret.Data[corev1.TLSPrivateKeyKey] = []byte{}
+	}
+	return secret
+}
+
+func getFile(secret *corev1.Secret, dir, file string) ([]byte, bool) {
+	value, ok := secret.Data[dataKey(dir, file)]
+	if !ok || len(value) == 0 && secret.Type == corev1.SecretTypeTLS {
+		return nil, false
+	}
+	return value, true
+}
+
+func setFile(secret *corev1.Secret, dir, file string, value []byte) {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	key := dataKey(dir, file)
+	secret.Data[key] = value
+	secret.Annotations[modifiedAnnotationPrefix+key] = time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func removeFile(secret *corev1.Secret, dir, file string) {
+	key := dataKey(dir, file)
+	if key == corev1.TLSCertKey || key == corev1.TLSPrivateKeyKey {
+		secret.Data[key] = []byte{}
+	} else {
+		delete(secret.Data, key)
+	}
+	delete(secret.Annotations, modifiedAnnotationPrefix+key)
+}
+
+// files returns the names of the files in secret.
+func files(secret *corev1.Secret) []string {
+	dir := secret.Annotations[keyAnnotation]
+	var names []string
+	for key := range secret.Data {
+		if _, ok := getFile(secret, dir, fileName(dir, key)); ok {
+			names = append(names, fileName(dir, key))
+		}
+	}
+	return names
+}
+
+// retryOnConflict runs fn again if another writer changed or created the object in between.
+func retryOnConflict(fn func() error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, fn)
+}
+
+// notExist returns an error for the operation op on key
+// that satisfies errors.Is(err, fs.ErrNotExist).
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+// Interface guard
+var _ acme.Storage = (*Storage)(nil)
@@ -0,0 +1,237 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mariuskimmina/tlsplus/acme"
+	"github.com/mariuskimmina/tlsplus/acme/storagetest"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestStorage(client *fake.Clientset) *Storage {
+	s := New(client, "kube-system")
+	s.lockPollInterval = 5 * time.Millisecond
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	s := newTestStorage(client)
+	ctx := context.Background()
+
+	if _, err := s.Load(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error for missing key, got: %v", err)
+	}
+
+	values := map[string]string{
+		"acme/ca/users/default/account.key":                               "account key",
+		"certificates/ca/example.com/example.com.crt":                     "certificate",
+		"certificates/ca/example.com/example.com.key":                     "private key",
+		"certificates/ca/example.com/example.com.json":                    "{}",
+		"certificates/ca/wildcard_.example.com/wildcard_.example.com.key": "wildcard key",
+	}
+	for key, value := range values {
+		if err := s.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("Failed to store %s: %s", key, err)
+		}
+	}
+	for key, value := range values {
+		loaded, err := s.Load(ctx, key)
+		if err != nil || string(loaded) != value {
+			t.Errorf("Expected %s to be %q, got %q: %v", key, value, loaded, err)
+		}
+	}
+
+	// certificates are kubernetes.io/tls Secrets other workloads can use
+	secret, err := client.CoreV1().Secrets("kube-system").Get(ctx, secretName("certificates/ca/example.com"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get certificate Secret: %s", err)
+	}
+	if secret.Type != corev1.SecretTypeTLS || string(secret.Data[corev1.TLSCertKey]) != "certificate" || string(secret.Data[corev1.TLSPrivateKeyKey]) != "private key" {
+		t.Errorf("Expected kubernetes.io/tls Secret with the certificate, got %s %v", secret.Type, secret.Data)
+	}
+	// which has both entries even before the certificate is stored
+	if _, err := s.Load(ctx, "certificates/ca/wildcard_.example.com/wildcard_.example.com.crt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected certificate that is not stored yet not to exist, got: %v", err)
+	}
+
+	info, err := s.Stat(ctx, "certificates/ca/example.com/example.com.crt")
+	if err != nil || !info.IsTerminal || info.Size != int64(len("certificate")) || info.Modified.IsZero() {
+		t.Errorf("Unexpected key info %+v: %v", info, err)
+	}
+	info, err = s.Stat(ctx, "certificates/ca")
+	if err != nil || info.IsTerminal {
+		t.Errorf("Expected non-terminal key info, got %+v: %v", info, err)
+	}
+	if s.Exists(ctx, "certificates/other") {
+		t.Errorf("Expected missing directory not to exist")
+	}
+
+	keys, err := s.List(ctx, "certificates", false)
+	if err != nil || !reflect.DeepEqual(keys, []string{"certificates/ca"}) {
+		t.Errorf("Unexpected keys %v: %v", keys, err)
+	}
+	keys, err = s.List(ctx, "certificates/ca", true)
+	expected := []string{
+		"certificates/ca/example.com",
+		"certificates/ca/example.com/example.com.crt",
+		"certificates/ca/example.com/example.com.json",
+		"certificates/ca/example.com/example.com.key",
+		"certificates/ca/wildcard_.example.com",
+		"certificates/ca/wildcard_.example.com/wildcard_.example.com.key",
+	}
+	if err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v: %v", expected, keys, err)
+	}
+
+	// the Secret is deleted along with its last file
+	for _, key := range []string{"certificates/ca/example.com/example.com.crt", "certificates/ca/example.com/example.com.key", "certificates/ca/example.com/example.com.json"} {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatalf("Failed to delete %s: %s", key, err)
+		}
+		if s.Exists(ctx, key) {
+			t.Errorf("Expected deleted key %s not to exist", key)
+		}
+	}
+	if _, err := client.CoreV1().Secrets("kube-system").Get(ctx, secretName("certificates/ca/example.com"), metav1.GetOptions{}); err == nil {
+		t.Errorf("Expected Secret without files to be deleted")
+	}
+
+	if err := s.Store(ctx, "certificates/ca/example.com/not:valid", []byte("value")); err == nil {
+		t.Errorf("Expected error for key that is not a valid data key")
+	}
+}
+
+func TestStorageConformance(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	storagetest.Test(t, newTestStorage(client), func() acme.Storage {
+		return newTestStorage(client)
+	})
+}
+
+func TestStorageLockReplicas(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	const replicas, iterations = 10, 5
+
+	var inside int32
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		s := newTestStorage(client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := s.Lock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to lock: %s", err)
+					return
+				}
+				if n := atomic.AddInt32(&inside, 1); n != 1 {
+					t.Errorf("Expected only one holder of the lock, got %d", n)
+				}
+				counter++
+				atomic.AddInt32(&inside, -1)
+				if err := s.Unlock(ctx, "certificates/example.com"); err != nil {
+					t.Errorf("Failed to unlock: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != replicas*iterations {
+		t.Errorf("Expected counter %d, got %d", replicas*iterations, counter)
+	}
+}
+
+func TestStorageLockContext(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	holder, waiter := newTestStorage(client), newTestStorage(client)
+	if err := holder.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := waiter.Lock(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected waiting for the lock to be cancelled, got: %v", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key"); err == nil {
+		t.Errorf("Expected error unlocking a lock held by someone else")
+	}
+
+	if err := holder.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+	if err := waiter.Lock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to lock released lock: %s", err)
+	}
+	if err := waiter.Unlock(context.Background(), "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+}
+
+func TestStorageLockExpired(t *testing.T) {
+	// a holder that died without releasing the lock
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	identity, duration := "dead-replica", int32(30)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName("key"), Namespace: "kube-system"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renewed,
+		},
+	}
+	client := fake.NewSimpleClientset(lease)
+	s := newTestStorage(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Expected expired lease to be taken over, got: %s", err)
+	}
+	taken, err := client.CoordinationV1().Leases("kube-system").Get(ctx, leaseName("key"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %s", err)
+	}
+	if holder(taken) != s.Identity || taken.Spec.LeaseTransitions == nil || *taken.Spec.LeaseTransitions != 1 {
+		t.Errorf("Expected lease to be held by %s after one transition, got %+v", s.Identity, taken.Spec)
+	}
+	if err := s.Unlock(ctx, "key"); err != nil {
+		t.Fatalf("Failed to unlock: %s", err)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{"", "coredns-tls-e3b0c44298"},
+		{"certificates/acme-v02.api.letsencrypt.org-directory/example.com", "coredns-tls-certificates-acme-v02-api-letsencrypt-org-directory-example-com-"},
+		{"acme/ca/users/Admin@example.com", "coredns-tls-acme-ca-users-admin-example-com-"},
+	}
+
+	for i, test := range tests {
+		name := secretName(test.dir)
+		if len(name) < len(test.expected) || name[:len(test.expected)] != test.expected {
+			t.Errorf("Test %d: Expected name starting with %s, got %s", i, test.expected, name)
+		}
+		if len(name) > 253 {
+			t.Errorf("Test %d: Expected name of at most 253 characters, got %d", i, len(name))
+		}
+	}
+}
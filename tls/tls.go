@@ -11,7 +11,9 @@ import (
 	"time"
 )
 
-func setTLSDefaults(ctls *tls.Config) {
+// SetTLSDefaults sets the TLS versions and cipher suites
+// CoreDNS accepts on ctls.
+func SetTLSDefaults(ctls *tls.Config) {
 	ctls.MinVersion = tls.VersionTLS12
 	ctls.MaxVersion = tls.VersionTLS13
 	ctls.CipherSuites = []uint16{
@@ -93,13 +95,13 @@ func NewTLSConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
 		return nil, fmt.Errorf("could not load TLS cert: %s", err)
 	}
 
-	roots, err := loadRoots(caPath)
+	roots, err := LoadRoots(caPath)
 	if err != nil {
 		return nil, err
 	}
 
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: roots}
-	setTLSDefaults(tlsConfig)
+	SetTLSDefaults(tlsConfig)
 
 	return tlsConfig, nil
 }
@@ -107,18 +109,21 @@ func NewTLSConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
 // NewTLSClientConfig returns a TLS config for a client connection
 // If caPath is empty, system CAs will be used
 func NewTLSClientConfig(caPath string) (*tls.Config, error) {
-	roots, err := loadRoots(caPath)
+	roots, err := LoadRoots(caPath)
 	if err != nil {
 		return nil, err
 	}
 
 	tlsConfig := &tls.Config{RootCAs: roots}
-	setTLSDefaults(tlsConfig)
+	SetTLSDefaults(tlsConfig)
 
 	return tlsConfig, nil
 }
 
-func loadRoots(caPath string) (*x509.CertPool, error) {
+// LoadRoots returns a certificate pool with the PEM encoded
+// certificates in caPath. If caPath is empty, nil is returned
+// so that system CAs will be used
+func LoadRoots(caPath string) (*x509.CertPool, error) {
 	if caPath == "" {
 		return nil, nil
 	}